@@ -1,7 +1,8 @@
-package main
+package mcminterface
 
 import (
 	"encoding/binary"
+	"fmt"
 )
 
 type Block struct {
@@ -14,6 +15,7 @@ type BHEADER struct {
 	Hdrlen  uint32
 	Maddr   [TXADDRLEN]byte
 	Mreward uint64
+	Raw     []byte // whole header of other lengths, such as neogenesis ledgers
 } // 2220
 
 type BTRAILER struct {
@@ -40,66 +42,45 @@ type TXQENTRY struct {
 	Tx_id        [HASHLEN]byte
 } // 8824
 
-// BHeaderFromBytes - convert bytes to a block header
-func bHeaderFromBytes(bytes []byte) BHEADER {
-	var header BHEADER
-
-	header.Hdrlen = binary.LittleEndian.Uint32(bytes[0:4])
-	if header.Hdrlen != 2220 {
-		return header
-	}
-	copy(header.Maddr[:], bytes[4:2212])
-	header.Mreward = binary.LittleEndian.Uint64(bytes[2212:2220])
-
-	return header
+// Get the block number of the trailer
+func (m *BTRAILER) BlockNum() uint64 {
+	return binary.LittleEndian.Uint64(m.Bnum[:])
 }
 
-func bBodyFromBytes(bytes []byte) []TXQENTRY {
-	var body []TXQENTRY
-
-	many_tx := len(bytes) / 8824
-
-	for i := 0; i < many_tx; i++ {
-		var tx TXQENTRY
-		copy(tx.Src_addr[:], bytes[i*8824:i*8824+2208])
-		copy(tx.Dst_addr[:], bytes[i*8824+2208:i*8824+4416])
-		copy(tx.Chg_addr[:], bytes[i*8824+4416:i*8824+6624])
-		copy(tx.Send_total[:], bytes[i*8824+6624:i*8824+6632])
-		copy(tx.Change_total[:], bytes[i*8824+6632:i*8824+6640])
-		copy(tx.Tx_fee[:], bytes[i*8824+6640:i*8824+6648])
-		copy(tx.Tx_sig[:], bytes[i*8824+6648:i*8824+8792])
-		copy(tx.Tx_id[:], bytes[i*8824+8792:i*8824+8824])
-		body = append(body, tx)
+// Check that trailers are the blocks from start on, each linked to the
+// previous one. prev, if not nil, is the trailer of block start-1.
+func checkTrailers(prev *BTRAILER, start uint64, trailers []BTRAILER) error {
+	for i := range trailers {
+		bnum := trailers[i].BlockNum()
+		if bnum != start+uint64(i) {
+			return fmt.Errorf("%w: got block %d, expected %d", ErrTrailerRange, bnum, start+uint64(i))
+		}
+		if prev != nil && trailers[i].Phash != prev.Bhash {
+			return fmt.Errorf("%w: block %d", ErrBrokenChain, bnum)
+		}
+		prev = &trailers[i]
 	}
-
-	return body
-}
-
-// BTrailerFromBytes - convert bytes to a block trailer
-func bTrailerFromBytes(bytes []byte) BTRAILER {
-	var trailer BTRAILER
-
-	copy(trailer.Phash[:], bytes[0:32])
-	copy(trailer.Bnum[:], bytes[32:40])
-	copy(trailer.Mfee[:], bytes[40:48])
-	copy(trailer.Tcount[:], bytes[48:52])
-	copy(trailer.Time0[:], bytes[52:56])
-	copy(trailer.Difficulty[:], bytes[56:60])
-	copy(trailer.Mroot[:], bytes[60:92])
-	copy(trailer.Nonce[:], bytes[92:124])
-	copy(trailer.Stime[:], bytes[124:128])
-	copy(trailer.Bhash[:], bytes[128:160])
-
-	return trailer
+	return nil
 }
 
 // convert bytes to a block
-func BlockFromBytes(bytes []byte) Block {
+func BlockFromBytes(bytes []byte) (Block, error) {
 	var block Block
+	err := block.UnmarshalBinary(bytes)
+	return block, err
+}
 
-	block.Header = bHeaderFromBytes(bytes)
-	block.Body = bBodyFromBytes(bytes[block.Header.Hdrlen : len(bytes)-160])
-	block.Trailer = bTrailerFromBytes(bytes[len(bytes)-160:])
-
-	return block
+// convert a trailer file, trailers one after the other, to its trailers
+func TrailersFromBytes(bytes []byte) ([]BTRAILER, error) {
+	if len(bytes)%BTRAILER_LEN != 0 {
+		return nil, &LengthError{Type: "trailer file", Expected: len(bytes) / BTRAILER_LEN * BTRAILER_LEN, Received: len(bytes)}
+	}
+	trailers := make([]BTRAILER, len(bytes)/BTRAILER_LEN)
+	for i := range trailers {
+		err := trailers[i].UnmarshalBinary(bytes[i*BTRAILER_LEN : (i+1)*BTRAILER_LEN])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return trailers, nil
 }
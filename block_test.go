@@ -0,0 +1,23 @@
+package mcminterface
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckTrailers(t *testing.T) {
+	chain := testChain(10)
+	if err := checkTrailers(&chain[2], 3, chain[3:]); err != nil {
+		t.Errorf("linked chain: %v", err)
+	}
+	if err := checkTrailers(nil, 4, chain[3:]); !errors.Is(err, ErrTrailerRange) {
+		t.Errorf("wrong start: got %v, want ErrTrailerRange", err)
+	}
+	gap := append(append([]BTRAILER(nil), chain[3:5]...), chain[6:]...)
+	if err := checkTrailers(nil, 3, gap); !errors.Is(err, ErrTrailerRange) {
+		t.Errorf("missing block: got %v, want ErrTrailerRange", err)
+	}
+	if err := checkTrailers(&chain[0], 3, chain[3:]); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("unlinked previous block: got %v, want ErrBrokenChain", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	mcm "github.com/NickP005/mcminterface"
+)
+
+// main function
+func main() {
+	// Connect to node 35.212.41.137 195.181.241.89 192.168.1.70
+	test := flag.String("test", "query_balance", "demo to run: query_balance, resolve_balance, dl_block, expand")
+	settings := flag.String("settings", mcm.DEFAULT_SETTINGS_PATH, "path of the settings file")
+	verbose := flag.Bool("v", false, "log connections and frames to stderr")
+	flag.Parse()
+
+	opts := []mcm.Option{mcm.WithSettingsPath(*settings)}
+	if *verbose {
+		opts = append(opts, mcm.WithLogger(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	}
+	client, err := mcm.NewClient(opts...)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	// Stop on interrupt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	switch *test {
+	case "query_balance":
+		test_query_balance(ctx, client)
+	case "resolve_balance":
+		test_resolve_balance(ctx, client)
+	case "dl_block":
+		test_dl_block(ctx)
+	case "expand":
+		test_expand(ctx, client)
+	default:
+		fmt.Println("Unknown test:", *test)
+		return
+	}
+	if err := client.SaveSettings(); err != nil {
+		fmt.Println("Error:", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	mcm "github.com/NickP005/mcminterface"
+)
+
+// Resolve tag 01b0ec67eb4e7c25a2aa34d6
+func test_resolve_balance(ctx context.Context, client *mcm.Client) {
+	addr, err := client.QueryResolveTagHex(ctx, "01b0ec67eb4e7c25a2aa34d6")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Address:", hex.EncodeToString(addr.Address[:]))
+	// print the balance
+	fmt.Println("Balance:", addr.GetAmount()/1000000000)
+}
+
+func test_dl_block(ctx context.Context) {
+	sd, err := mcm.ConnectToNode(ctx, "192.168.1.70")
+	if err != nil {
+		fmt.Println("Connection failed:", err)
+		return
+	}
+	defer sd.Close()
+	fmt.Println("Block number:", sd.GetBlockNum())
+	var file bytes.Buffer
+	_, err = sd.GetBlockTo(ctx, sd.GetBlockNum(), &file, func(received int64) {
+		fmt.Printf("\rReceived %d bytes", received)
+	})
+	fmt.Println("")
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	block, err := mcm.BlockFromBytes(file.Bytes())
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	// print how many transactions are in the block
+	fmt.Println("Transactions:", len(block.Body))
+}
+
+func test_query_balance(ctx context.Context, client *mcm.Client) {
+	// resolve tag
+	tag := []byte{0x01, 0xb0, 0xec, 0x67, 0xeb, 0x4e, 0x7c, 0x25, 0xa2, 0xaa, 0x34, 0xd6}
+
+	addr, err := client.QueryResolveTag(ctx, tag)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	bal, err := client.QueryBalance(ctx, hex.EncodeToString(addr.Address[:]))
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	fmt.Println("Balance:", bal)
+
+}
+
+func test_expand(ctx context.Context, client *mcm.Client) {
+	if err := client.ExpandIPs(ctx); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	// print IPs
+	fmt.Println("IPs:", client.Settings().IPs)
+	if err := client.BenchmarkNodes(ctx, 10); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	nodes := client.PickNodes(5)
+	// for each node print ip
+	for _, node := range nodes {
+		fmt.Print(node.IP, ":", node.Ping, " ")
+	}
+	fmt.Println("")
+}
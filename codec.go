@@ -0,0 +1,245 @@
+package mcminterface
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sigurn/crc16"
+)
+
+// Lengths of the binary structures
+const (
+	TX_LEN         = 8920 // TX frame on the wire
+	TX_CRC_LEN     = 8916 // part of the frame covered by the crc16
+	TX_BUFFER_OFF  = 124  // start of the payload of OP_SEND_FILE frames (Src_addr)
+	TX_BUFFER_LEN  = 8792 // payload capacity, from Src_addr to the end of Tx_sig
+	BHEADER_LEN    = 2220 // header of a normal block
+	BTRAILER_LEN   = 160
+	TXQENTRY_LEN   = 8824
+	BHEADER_MINLEN = 4 // pseudo-block header, only Hdrlen
+)
+
+// crc16 table of the frames, built once
+var crc_table = crc16.MakeTable(crc16.CRC16_XMODEM)
+
+// Pool of frame buffers shared by all the sockets
+var frame_pool = sync.Pool{
+	New: func() any {
+		return new([TX_LEN]byte)
+	},
+}
+
+// Compute the crc16 of an encoded frame
+func frameCRC16(frame []byte) uint16 {
+	return crc16.Checksum(frame[:TX_CRC_LEN], crc_table)
+}
+
+// ErrInvalidLength is matched by every LengthError
+var ErrInvalidLength = errors.New("invalid length")
+
+// LengthError reports binary input with the wrong length for Type
+type LengthError struct {
+	Type     string
+	Expected int
+	Received int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("invalid %s length: expected %d bytes, got %d", e.Type, e.Expected, e.Received)
+}
+
+func (e *LengthError) Is(target error) bool {
+	return target == ErrInvalidLength
+}
+
+// Copy data into fields in order, data must be exactly as long as the fields
+func decodeFields(name string, data []byte, fields ...[]byte) error {
+	size := 0
+	for _, field := range fields {
+		size += len(field)
+	}
+	if len(data) != size {
+		return &LengthError{Type: name, Expected: size, Received: len(data)}
+	}
+	offset := 0
+	for _, field := range fields {
+		offset += copy(field, data[offset:])
+	}
+	return nil
+}
+
+// Append fields in order to buf
+func encodeFields(buf []byte, fields ...[]byte) []byte {
+	for _, field := range fields {
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+// Fields of the TX struct in wire order
+func (m *TX) fields() [20][]byte {
+	return [20][]byte{
+		m.Version[:], m.Network[:], m.ID1[:], m.ID2[:], m.Opcode[:],
+		m.Cblock[:], m.Blocknum[:], m.Cblockhash[:], m.Pblockhash[:], m.Weight[:],
+		m.Len[:], m.Src_addr[:], m.Dst_addr[:], m.Chg_addr[:],
+		m.Send_total[:], m.Change_total[:], m.Tx_fee[:], m.Tx_sig[:],
+		m.Crc16[:], m.Trailer[:],
+	}
+}
+
+// Encode the TX frame as sent on the wire
+func (m *TX) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(make([]byte, 0, TX_LEN))
+}
+
+// Append the encoded TX frame to buf, it does not allocate if
+// buf has room for TX_LEN more bytes
+func (m *TX) AppendBinary(buf []byte) ([]byte, error) {
+	fields := m.fields()
+	return encodeFields(buf, fields[:]...), nil
+}
+
+// Decode a TX frame, data must be exactly TX_LEN bytes
+func (m *TX) UnmarshalBinary(data []byte) error {
+	fields := m.fields()
+	return decodeFields("TX", data, fields[:]...)
+}
+
+// Fields of the BTRAILER struct in wire order
+func (m *BTRAILER) fields() [10][]byte {
+	return [10][]byte{
+		m.Phash[:], m.Bnum[:], m.Mfee[:], m.Tcount[:], m.Time0[:],
+		m.Difficulty[:], m.Mroot[:], m.Nonce[:], m.Stime[:], m.Bhash[:],
+	}
+}
+
+// Encode the block trailer
+func (m *BTRAILER) MarshalBinary() ([]byte, error) {
+	fields := m.fields()
+	return encodeFields(make([]byte, 0, BTRAILER_LEN), fields[:]...), nil
+}
+
+// Decode a block trailer, data must be exactly BTRAILER_LEN bytes
+func (m *BTRAILER) UnmarshalBinary(data []byte) error {
+	fields := m.fields()
+	return decodeFields("BTRAILER", data, fields[:]...)
+}
+
+// Fields of the TXQENTRY struct in wire order
+func (m *TXQENTRY) fields() [8][]byte {
+	return [8][]byte{
+		m.Src_addr[:], m.Dst_addr[:], m.Chg_addr[:],
+		m.Send_total[:], m.Change_total[:], m.Tx_fee[:],
+		m.Tx_sig[:], m.Tx_id[:],
+	}
+}
+
+// Encode the transaction entry
+func (m *TXQENTRY) MarshalBinary() ([]byte, error) {
+	fields := m.fields()
+	return encodeFields(make([]byte, 0, TXQENTRY_LEN), fields[:]...), nil
+}
+
+// Decode a transaction entry, data must be exactly TXQENTRY_LEN bytes
+func (m *TXQENTRY) UnmarshalBinary(data []byte) error {
+	fields := m.fields()
+	return decodeFields("TXQENTRY", data, fields[:]...)
+}
+
+// Encode the block header. Headers other than normal (BHEADER_LEN) and
+// pseudo-block (BHEADER_MINLEN) ones are encoded from Raw, which must be
+// Hdrlen bytes long.
+func (m *BHEADER) MarshalBinary() ([]byte, error) {
+	switch m.Hdrlen {
+	case BHEADER_LEN:
+		buf := make([]byte, BHEADER_LEN)
+		binary.LittleEndian.PutUint32(buf[0:4], m.Hdrlen)
+		copy(buf[4:4+TXADDRLEN], m.Maddr[:])
+		binary.LittleEndian.PutUint64(buf[4+TXADDRLEN:], m.Mreward)
+		return buf, nil
+	case BHEADER_MINLEN:
+		return binary.LittleEndian.AppendUint32(nil, m.Hdrlen), nil
+	}
+	if uint64(len(m.Raw)) == uint64(m.Hdrlen) && len(m.Raw) >= BHEADER_MINLEN {
+		buf := bytes.Clone(m.Raw)
+		binary.LittleEndian.PutUint32(buf[0:4], m.Hdrlen)
+		return buf, nil
+	}
+	return nil, fmt.Errorf("cannot encode block header of length %d", m.Hdrlen)
+}
+
+// Decode a block header, data must be exactly Hdrlen bytes.
+// Maddr and Mreward are only present in normal headers (BHEADER_LEN),
+// headers of other lengths such as neogenesis ledgers are kept in Raw.
+func (m *BHEADER) UnmarshalBinary(data []byte) error {
+	if len(data) < BHEADER_MINLEN {
+		return &LengthError{Type: "BHEADER", Expected: BHEADER_MINLEN, Received: len(data)}
+	}
+	hdrlen := binary.LittleEndian.Uint32(data[0:4])
+	if uint64(hdrlen) != uint64(len(data)) {
+		return &LengthError{Type: "BHEADER", Expected: int(hdrlen), Received: len(data)}
+	}
+	*m = BHEADER{Hdrlen: hdrlen}
+	switch hdrlen {
+	case BHEADER_LEN:
+		copy(m.Maddr[:], data[4:4+TXADDRLEN])
+		m.Mreward = binary.LittleEndian.Uint64(data[4+TXADDRLEN:])
+	case BHEADER_MINLEN:
+		// only Hdrlen
+	default:
+		m.Raw = bytes.Clone(data)
+	}
+	return nil
+}
+
+// Encode the block: header, body and trailer
+func (m *Block) MarshalBinary() ([]byte, error) {
+	buf, err := m.Header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	for i := range m.Body {
+		fields := m.Body[i].fields()
+		buf = encodeFields(buf, fields[:]...)
+	}
+	fields := m.Trailer.fields()
+	return encodeFields(buf, fields[:]...), nil
+}
+
+// Decode a block. The header length is read from the data, the
+// body must be a whole number of TXQENTRY_LEN entries.
+func (m *Block) UnmarshalBinary(data []byte) error {
+	if len(data) < BHEADER_MINLEN+BTRAILER_LEN {
+		return &LengthError{Type: "Block", Expected: BHEADER_MINLEN + BTRAILER_LEN, Received: len(data)}
+	}
+	hdrlen := uint64(binary.LittleEndian.Uint32(data[0:4]))
+	if hdrlen < BHEADER_MINLEN || hdrlen > uint64(len(data)-BTRAILER_LEN) {
+		return fmt.Errorf("%w: block header length %d out of range for %d bytes", ErrInvalidLength, hdrlen, len(data))
+	}
+	body := data[hdrlen : len(data)-BTRAILER_LEN]
+	if len(body)%TXQENTRY_LEN != 0 {
+		return &LengthError{Type: "Block body", Expected: len(body) / TXQENTRY_LEN * TXQENTRY_LEN, Received: len(body)}
+	}
+
+	var block Block
+	err := block.Header.UnmarshalBinary(data[:hdrlen])
+	if err != nil {
+		return err
+	}
+	block.Body = make([]TXQENTRY, len(body)/TXQENTRY_LEN)
+	for i := range block.Body {
+		err = block.Body[i].UnmarshalBinary(body[i*TXQENTRY_LEN : (i+1)*TXQENTRY_LEN])
+		if err != nil {
+			return err
+		}
+	}
+	err = block.Trailer.UnmarshalBinary(data[len(data)-BTRAILER_LEN:])
+	if err != nil {
+		return err
+	}
+	*m = block
+	return nil
+}
@@ -0,0 +1,232 @@
+package mcminterface
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// A normal block with entries random transaction entries
+func testBlock(entries int) Block {
+	var block Block
+	block.Header.Hdrlen = BHEADER_LEN
+	block.Header.Mreward = 5000000000
+	rand.Read(block.Header.Maddr[:])
+	block.Body = make([]TXQENTRY, entries)
+	for i := range block.Body {
+		rand.Read(block.Body[i].Src_addr[:])
+		rand.Read(block.Body[i].Tx_sig[:])
+		rand.Read(block.Body[i].Tx_id[:])
+	}
+	rand.Read(block.Trailer.Phash[:])
+	rand.Read(block.Trailer.Bnum[:])
+	rand.Read(block.Trailer.Bhash[:])
+	return block
+}
+
+// A block with a header longer than a normal one, as a neogenesis block
+func testLongHeaderBlock() Block {
+	block := testBlock(0)
+	raw := make([]byte, BHEADER_LEN+100)
+	rand.Read(raw)
+	binary.LittleEndian.PutUint32(raw, uint32(len(raw)))
+	block.Header = BHEADER{Hdrlen: uint32(len(raw)), Raw: raw}
+	return block
+}
+
+// A trailer file of count random trailers
+func testTrailerFile(count int) []byte {
+	tfile := make([]byte, count*BTRAILER_LEN)
+	rand.Read(tfile)
+	return tfile
+}
+
+func TestTXRoundTrip(t *testing.T) {
+	frame := make([]byte, TX_LEN)
+	rand.Read(frame)
+	var tx TX
+	if err := tx.UnmarshalBinary(frame); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := tx.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, frame) {
+		t.Error("encoded frame differs")
+	}
+
+	prefix := []byte("prefix")
+	appended, _ := tx.AppendBinary(prefix)
+	if !bytes.Equal(appended[:len(prefix)], prefix) || !bytes.Equal(appended[len(prefix):], frame) {
+		t.Error("AppendBinary does not append the frame")
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	blocks := map[string]Block{
+		"empty body":    testBlock(0),
+		"three entries": testBlock(3),
+		"pseudo-block":  {Header: BHEADER{Hdrlen: BHEADER_MINLEN}},
+		"long header":   testLongHeaderBlock(),
+	}
+	for name, block := range blocks {
+		encoded, err := block.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := int(block.Header.Hdrlen) + len(block.Body)*TXQENTRY_LEN + BTRAILER_LEN
+		if len(encoded) != want {
+			t.Errorf("%s: encoded %d bytes, want %d", name, len(encoded), want)
+		}
+		decoded, err := BlockFromBytes(encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		reencoded, _ := decoded.MarshalBinary()
+		if !bytes.Equal(reencoded, encoded) {
+			t.Errorf("%s: encoded block differs", name)
+		}
+	}
+}
+
+func TestTrailersFromBytes(t *testing.T) {
+	tfile := testTrailerFile(4)
+	trailers, err := TrailersFromBytes(tfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trailers) != 4 {
+		t.Fatalf("%d trailers, want 4", len(trailers))
+	}
+	for i := range trailers {
+		encoded, _ := trailers[i].MarshalBinary()
+		if !bytes.Equal(encoded, tfile[i*BTRAILER_LEN:(i+1)*BTRAILER_LEN]) {
+			t.Errorf("trailer %d differs", i)
+		}
+	}
+}
+
+func TestDecodeInvalidLength(t *testing.T) {
+	block := testBlock(1)
+	encoded, _ := block.MarshalBinary()
+	var tx TX
+	var header BHEADER
+	var trailer BTRAILER
+	var entry TXQENTRY
+	tests := map[string]error{
+		"TX":              tx.UnmarshalBinary(make([]byte, TX_LEN-1)),
+		"BHEADER":         header.UnmarshalBinary(make([]byte, 2)),
+		"BHEADER Hdrlen":  header.UnmarshalBinary([]byte{8, 0, 0, 0, 0}),
+		"BTRAILER":        trailer.UnmarshalBinary(make([]byte, BTRAILER_LEN+1)),
+		"TXQENTRY":        entry.UnmarshalBinary(nil),
+		"truncated block": func() error { _, err := BlockFromBytes(encoded[:len(encoded)-1]); return err }(),
+		"trailer file":    func() error { _, err := TrailersFromBytes(make([]byte, BTRAILER_LEN+3)); return err }(),
+	}
+	for name, err := range tests {
+		if !errors.Is(err, ErrInvalidLength) {
+			t.Errorf("%s: got %v, want ErrInvalidLength", name, err)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	tx := NewTX(nil)
+	rand.Read(tx.Tx_sig[:])
+	buf := make([]byte, 0, TX_LEN)
+	b.ReportAllocs()
+	b.SetBytes(TX_LEN)
+	for i := 0; i < b.N; i++ {
+		tx.computeCRC16()
+		tx.AppendBinary(buf[:0])
+	}
+}
+
+func FuzzTXUnmarshalBinary(f *testing.F) {
+	frame := make([]byte, TX_LEN)
+	rand.Read(frame)
+	f.Add(frame)
+	tx := NewTX(nil)
+	encoded, _ := tx.MarshalBinary()
+	f.Add(encoded)
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var tx TX
+		if tx.UnmarshalBinary(data) != nil {
+			return
+		}
+		encoded, _ := tx.MarshalBinary()
+		if !bytes.Equal(encoded, data) {
+			t.Error("decoded frame does not encode back to the input")
+		}
+	})
+}
+
+func FuzzBlockFromBytes(f *testing.F) {
+	for _, block := range []Block{testBlock(0), testBlock(2), {Header: BHEADER{Hdrlen: BHEADER_MINLEN}}, testLongHeaderBlock()} {
+		encoded, _ := block.MarshalBinary()
+		f.Add(encoded)
+	}
+	f.Add([]byte{0xac, 0x08, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block, err := BlockFromBytes(data)
+		if err != nil {
+			return
+		}
+		encoded, err := block.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Error("decoded block does not encode back to the input")
+		}
+	})
+}
+
+func FuzzBHEADERUnmarshalBinary(f *testing.F) {
+	block := testBlock(0)
+	encoded, _ := block.Header.MarshalBinary()
+	f.Add(encoded)
+	f.Add([]byte{BHEADER_MINLEN, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{6, 0, 0, 0, 1, 2})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var header BHEADER
+		if header.UnmarshalBinary(data) != nil {
+			return
+		}
+		encoded, err := header.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Error("decoded header does not encode back to the input")
+		}
+	})
+}
+
+func FuzzTrailersFromBytes(f *testing.F) {
+	f.Add(testTrailerFile(1))
+	f.Add(testTrailerFile(3))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		trailers, err := TrailersFromBytes(data)
+		if err != nil {
+			return
+		}
+		encoded := make([]byte, 0, len(data))
+		for i := range trailers {
+			trailer, _ := trailers[i].MarshalBinary()
+			encoded = append(encoded, trailer...)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Error("decoded trailers do not encode back to the input")
+		}
+	})
+}
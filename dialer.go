@@ -0,0 +1,257 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Dialer opens the connections to the nodes. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// HostnameResolver is implemented by the dialers that resolve host names
+// themselves, such as proxies, Connect then passes the host names unresolved
+type HostnameResolver interface {
+	ResolvesHostnames() bool
+}
+
+// ErrProxy is matched by the errors of a SOCKS5 proxy refusing a connection
+var ErrProxy = errors.New("socks5 proxy error")
+
+// SOCKS5Dialer dials nodes through a SOCKS5 proxy (RFC 1928), such as Tor,
+// with optional username/password authentication (RFC 1929)
+type SOCKS5Dialer struct {
+	ProxyAddress string // host:port of the proxy
+	Username     string // empty for no authentication
+	Password     string
+	Forward      Dialer // dials the proxy, nil for a net.Dialer
+}
+
+// SOCKS5 protocol values
+const (
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+	socks5AuthRefused  = 0xff
+	socks5Connect      = 1
+	socks5AtypIPv4     = 1
+	socks5AtypDomain   = 3
+	socks5AtypIPv6     = 4
+)
+
+// Reply codes of a SOCKS5 CONNECT
+var socks5Replies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Host names are resolved by the proxy
+func (d *SOCKS5Dialer) ResolvesHostnames() bool {
+	return true
+}
+
+// Connect to address through the proxy
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (_ net.Conn, err error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("%w: network %s not supported", ErrProxy, network)
+	}
+	host, port_str, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(port_str, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", port_str, err)
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	conn, err := forward.DialContext(ctx, "tcp", d.ProxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	// Bound the proxy negotiation by ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		stop()
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+
+	err = d.negotiate(conn)
+	if err != nil {
+		return nil, err
+	}
+	err = d.connect(conn, host, uint16(port))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Select the authentication method and authenticate
+func (d *SOCKS5Dialer) negotiate(conn net.Conn) error {
+	methods := []byte{socks5AuthNone}
+	if d.Username != "" {
+		methods = []byte{socks5AuthNone, socks5AuthPassword}
+	}
+	_, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	var reply [2]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("%w: unexpected version %d", ErrProxy, reply[0])
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+		return nil
+	case socks5AuthPassword:
+		if d.Username == "" || len(d.Username) > 255 || len(d.Password) > 255 {
+			return fmt.Errorf("%w: invalid credentials", ErrProxy)
+		}
+		request := []byte{1, byte(len(d.Username))}
+		request = append(request, d.Username...)
+		request = append(request, byte(len(d.Password)))
+		request = append(request, d.Password...)
+		_, err = conn.Write(request)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply[:])
+		if err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("%w: authentication failed", ErrProxy)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: no acceptable authentication method", ErrProxy)
+}
+
+// Ask the proxy to connect to host:port
+func (d *SOCKS5Dialer) connect(conn net.Conn, host string, port uint16) error {
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request = append(request, socks5AtypIPv4)
+			request = append(request, ip4...)
+		} else {
+			request = append(request, socks5AtypIPv6)
+			request = append(request, ip.To16()...)
+		}
+	} else {
+		// let the proxy resolve the host name
+		if len(host) > 255 {
+			return fmt.Errorf("%w: host name too long", ErrProxy)
+		}
+		request = append(request, socks5AtypDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, port)
+	_, err := conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	// version, reply, reserved, address type
+	var reply [4]byte
+	_, err = io.ReadFull(conn, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("%w: unexpected version %d", ErrProxy, reply[0])
+	}
+	if reply[1] == 5 {
+		return fmt.Errorf("%w: %w", ErrProxy, ErrConnectionRefused)
+	}
+	if reply[1] != 0 {
+		message, ok := socks5Replies[reply[1]]
+		if !ok {
+			message = fmt.Sprintf("reply %d", reply[1])
+		}
+		return fmt.Errorf("%w: %s", ErrProxy, message)
+	}
+
+	// Skip the bound address and port
+	var skip int
+	switch reply[3] {
+	case socks5AtypIPv4:
+		skip = net.IPv4len + 2
+	case socks5AtypIPv6:
+		skip = net.IPv6len + 2
+	case socks5AtypDomain:
+		var length [1]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return fmt.Errorf("%w: unexpected address type %d", ErrProxy, reply[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(skip))
+	return err
+}
+
+// Get a dialer like d that binds the local side of its connections to
+// local. The default dialer and the forward dialer of a SOCKS5Dialer
+// support it, other dialers must do the binding themselves.
+func bindDialer(d Dialer, local string) (Dialer, error) {
+	ip := net.ParseIP(local)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address %q", local)
+	}
+	local_addr := &net.TCPAddr{IP: ip}
+	switch dialer := d.(type) {
+	case nil:
+		return &net.Dialer{LocalAddr: local_addr}, nil
+	case *net.Dialer:
+		bound := *dialer
+		bound.LocalAddr = local_addr
+		return &bound, nil
+	case *SOCKS5Dialer:
+		forward, err := bindDialer(dialer.Forward, local)
+		if err != nil {
+			return nil, err
+		}
+		bound := *dialer
+		bound.Forward = forward
+		return &bound, nil
+	}
+	return nil, fmt.Errorf("source address binding not supported by %T", d)
+}
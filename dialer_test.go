@@ -0,0 +1,177 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// Minimal SOCKS5 proxy with username/password authentication, it counts
+// the connections it relays
+func serveSOCKS5(listener net.Listener, username, password string, relayed *atomic.Int32) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			buf := make([]byte, 512)
+			// greeting
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+				return
+			}
+			conn.Write([]byte{socks5Version, socks5AuthPassword})
+			// username and password
+			if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+				return
+			}
+			user := make([]byte, buf[1])
+			io.ReadFull(conn, user)
+			io.ReadFull(conn, buf[:1])
+			pass := make([]byte, buf[0])
+			io.ReadFull(conn, pass)
+			if string(user) != username || string(pass) != password {
+				conn.Write([]byte{1, 1})
+				return
+			}
+			conn.Write([]byte{1, 0})
+			// connect request, IPv4 only
+			if _, err := io.ReadFull(conn, buf[:10]); err != nil || buf[3] != socks5AtypIPv4 {
+				return
+			}
+			address := net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf[8:10]))))
+			target, err := net.Dial("tcp", address)
+			if err != nil {
+				conn.Write([]byte{socks5Version, 5, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer target.Close()
+			relayed.Add(1)
+			conn.Write([]byte{socks5Version, 0, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}(conn)
+	}
+}
+
+func TestDialers(t *testing.T) {
+	address := randomAddress()
+	_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetBalance(address, 555)
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var relayed atomic.Int32
+	go serveSOCKS5(listener, "user", "secret", &relayed)
+
+	query := func(opts ...Option) error {
+		client := newMockClient(t, addrs, opts...)
+		balance, err := client.QueryBalance(context.Background(), hex.EncodeToString(address[:]))
+		if err == nil && balance != 555 {
+			t.Errorf("balance %d, want 555", balance)
+		}
+		return err
+	}
+
+	proxy := &SOCKS5Dialer{ProxyAddress: listener.Addr().String(), Username: "user", Password: "secret"}
+	if err := query(WithDialer(proxy), WithSourceAddress("", "127.0.0.1")); err != nil {
+		t.Errorf("query through the proxy: %v", err)
+	}
+	if relayed.Load() != 1 {
+		t.Errorf("%d connections relayed by the proxy, want 1", relayed.Load())
+	}
+	wrong := &SOCKS5Dialer{ProxyAddress: listener.Addr().String(), Username: "user", Password: "wrong"}
+	if err := query(WithDialer(wrong)); err == nil {
+		t.Error("query through the proxy with a wrong password succeeded")
+	}
+	if err := query(WithSourceAddress(addrs[0], "127.0.0.1")); err != nil {
+		t.Errorf("query with a source address: %v", err)
+	}
+	// The node is matched however it is written, binding it to an address
+	// of no local interface (TEST-NET-1) makes the query fail
+	host, port, _ := net.SplitHostPort(addrs[0])
+	if err := query(WithSourceAddress("["+host+"]:"+port, "192.0.2.1")); err == nil {
+		t.Error("query bound to 192.0.2.1 succeeded")
+	}
+}
+
+func TestSourceAddressKeys(t *testing.T) {
+	client, err := NewClient(
+		WithSourceAddress("1.2.3.4:2095", "10.0.0.1"),
+		WithSourceAddress("[::1]:2095", "10.0.0.2"),
+		WithSourceAddress("node.example:3000", "10.0.0.3"),
+		WithSourceAddress("", "10.0.0.4"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"1.2.3.4": "10.0.0.1", "::1": "10.0.0.2", "node.example:3000": "10.0.0.3", "": "10.0.0.4"}
+	if !reflect.DeepEqual(client.source_addrs, want) {
+		t.Errorf("source addresses %v, want %v", client.source_addrs, want)
+	}
+}
+
+// A net.Dialer keeping the addresses it is asked to dial
+type recordingDialer struct {
+	net.Dialer
+	dialed []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, address)
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+// A recordingDialer that resolves host names itself
+type resolvingDialer struct {
+	recordingDialer
+}
+
+func (d *resolvingDialer) ResolvesHostnames() bool {
+	return true
+}
+
+func TestHostnameResolver(t *testing.T) {
+	_, addrs := startMockNodes(t, 1, nil)
+	host := localhostAddr(addrs[0])
+	ctx := context.Background()
+
+	resolving := &resolvingDialer{}
+	sd := SocketData{IP: host, Dialer: resolving}
+	if err := sd.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sd.Close()
+	if len(resolving.dialed) != 1 || resolving.dialed[0] != host {
+		t.Errorf("resolving dialer dialed %v, want %s", resolving.dialed, host)
+	}
+
+	plain := &recordingDialer{}
+	sd = SocketData{IP: host, Dialer: plain}
+	if err := sd.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sd.Close()
+	if len(plain.dialed) == 0 {
+		t.Fatal("nothing dialed")
+	}
+	for _, address := range plain.dialed {
+		ip, _, _ := net.SplitHostPort(address)
+		if net.ParseIP(ip) == nil {
+			t.Errorf("dialer received the host name %s", address)
+		}
+	}
+}
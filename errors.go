@@ -0,0 +1,172 @@
+package mcminterface
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Protocol errors, usable with errors.Is
+var (
+	ErrNotConnected      = errors.New("connection is nil")
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrShortRead         = errors.New("short read")
+	ErrChecksum          = errors.New("crc16 checksum failed")
+	ErrBadTrailer        = errors.New("trailer failed")
+	ErrWrongNetwork      = errors.New("wrong network")
+	ErrWrongVersion      = errors.New("wrong protocol version")
+	ErrSessionMismatch   = errors.New("frame does not belong to the session")
+	ErrUnexpectedOpcode  = errors.New("unexpected opcode")
+	ErrNodeBusy          = errors.New("node is busy")
+	ErrNACK              = errors.New("node replied NACK")
+	ErrTagNotFound       = errors.New("tag not found")
+	ErrAddressNotFound   = errors.New("address not found")
+	ErrBlockNotFound     = errors.New("block not found")
+	ErrFileTooLarge      = errors.New("file too large")
+	ErrNoQuorum          = errors.New("no result reaches quorum")
+	ErrTxRejected        = errors.New("transaction rejected")
+	ErrTxUnconfirmed     = errors.New("connection closed without acknowledging the transaction")
+	ErrTrailerRange      = errors.New("trailer out of the requested range")
+	ErrBrokenChain       = errors.New("trailer does not link to the previous block")
+)
+
+// Name of an opcode, for error messages and logs
+func OpcodeName(op uint16) string {
+	switch op {
+	case OP_NULL:
+		return "OP_NULL"
+	case OP_HELLO:
+		return "OP_HELLO"
+	case OP_HELLO_ACK:
+		return "OP_HELLO_ACK"
+	case OP_TX:
+		return "OP_TX"
+	case OP_FOUND:
+		return "OP_FOUND"
+	case OP_GET_BLOCK:
+		return "OP_GET_BLOCK"
+	case OP_GET_IPL:
+		return "OP_GET_IPL"
+	case OP_SEND_FILE:
+		return "OP_SEND_FILE"
+	case OP_SEND_IPL:
+		return "OP_SEND_IPL"
+	case OP_BUSY:
+		return "OP_BUSY"
+	case OP_NACK:
+		return "OP_NACK"
+	case OP_GET_TFILE:
+		return "OP_GET_TFILE"
+	case OP_BALANCE:
+		return "OP_BALANCE"
+	case OP_SEND_BAL:
+		return "OP_SEND_BAL"
+	case OP_RESOLVE:
+		return "OP_RESOLVE"
+	case OP_GET_CBLOCK:
+		return "OP_GET_CBLOCK"
+	case OP_MBLOCK:
+		return "OP_MBLOCK"
+	case OP_HASH:
+		return "OP_HASH"
+	case OP_TF:
+		return "OP_TF"
+	case OP_IDENTIFY:
+		return "OP_IDENTIFY"
+	}
+	return fmt.Sprintf("OP_%d", op)
+}
+
+// CRCError reports a frame whose crc16 does not match its content
+type CRCError struct {
+	Expected uint16 // checksum computed over the received frame
+	Actual   uint16 // checksum carried by the received frame
+}
+
+func (e *CRCError) Error() string {
+	return fmt.Sprintf("crc16 checksum failed: expected %04x, got %04x", e.Expected, e.Actual)
+}
+
+func (e *CRCError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// OpcodeError reports a reply with a different opcode than expected.
+// It matches ErrNodeBusy and ErrNACK when the node replied OP_BUSY or OP_NACK.
+type OpcodeError struct {
+	Expected uint16
+	Received uint16
+}
+
+func (e *OpcodeError) Error() string {
+	return fmt.Sprintf("opcode is not %s: received %s", OpcodeName(e.Expected), OpcodeName(e.Received))
+}
+
+func (e *OpcodeError) Is(target error) bool {
+	switch target {
+	case ErrUnexpectedOpcode:
+		return true
+	case ErrNodeBusy:
+		return e.Received == OP_BUSY
+	case ErrNACK:
+		return e.Received == OP_NACK
+	}
+	return false
+}
+
+// FrameError reports a received frame rejected by validation.
+// Err is ErrWrongVersion, ErrWrongNetwork or ErrSessionMismatch.
+type FrameError struct {
+	Field    string // Version, Network, ID1 or ID2
+	Expected uint16
+	Received uint16
+	Err      error
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%v: %s is %04x, expected %04x", e.Err, e.Field, e.Received, e.Expected)
+}
+
+func (e *FrameError) Unwrap() error {
+	return e.Err
+}
+
+// ShortReadError reports a frame that ended before all of its bytes arrived
+type ShortReadError struct {
+	Expected int
+	Received int
+	Err      error // underlying read error
+}
+
+func (e *ShortReadError) Error() string {
+	return fmt.Sprintf("received %d of %d bytes: %v", e.Received, e.Expected, e.Err)
+}
+
+func (e *ShortReadError) Is(target error) bool {
+	return target == ErrShortRead
+}
+
+func (e *ShortReadError) Unwrap() error {
+	return e.Err
+}
+
+// QuorumError reports a query where no result reaches quorum,
+// with the final outcome of every node that was asked
+type QuorumError struct {
+	Query    string
+	Quorum   int
+	Outcomes []NodeOutcome
+}
+
+func (e *QuorumError) Error() string {
+	failed := 0
+	for _, outcome := range e.Outcomes {
+		if outcome.Err != nil {
+			failed++
+		}
+	}
+	return fmt.Sprintf("no %s reaches quorum of %d: %d of %d nodes failed", e.Query, e.Quorum, failed, len(e.Outcomes))
+}
+
+func (e *QuorumError) Is(target error) bool {
+	return target == ErrNoQuorum
+}
@@ -0,0 +1,170 @@
+package mcminterface
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capabilities are the bits a node announces in Version[1] of its frames
+type Capabilities uint8
+
+const (
+	CapPush      Capabilities = 1 << iota // C_PUSH: the peer pushes blocks
+	CapWallet                             // C_WALLET: the peer is a wallet
+	CapSanctuary                          // C_SANCTUARY: the node has a sanctuary set
+	CapMfee                               // C_MFEE: the node has a custom mining fee
+	CapLogging                            // C_LOGGING: the node logs
+)
+
+// Names of the capability bits, in bit order
+var capability_names = []string{"push", "wallet", "sanctuary", "mfee", "logging"}
+
+func (c Capabilities) String() string {
+	names := make([]string, 0)
+	for i, name := range capability_names {
+		if c&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// NodeIdentity is what a node reports to OP_IDENTIFY. The reply carries
+// comma separated key=value fields, Software and Ops are understood and
+// every field is kept in Fields.
+type NodeIdentity struct {
+	Version      uint8             // protocol version, Version[0] of the reply
+	Capabilities Capabilities      // Version[1] of the reply
+	Software     string            `json:",omitempty"` // software name and version
+	Opcodes      []uint16          `json:",omitempty"` // opcodes served, nil if the node does not tell
+	Fields       map[string]string `json:",omitempty"`
+	Updated      time.Time         // time of the reply
+}
+
+// Check if the node serves op. The handshake is always served, and a nil
+// identity or one without an opcode list is assumed to serve every opcode
+// of the protocol.
+func (id *NodeIdentity) Supports(op uint16) bool {
+	if op < FIRST_OP {
+		return true
+	}
+	if id == nil || id.Opcodes == nil {
+		return op <= LAST_OP
+	}
+	return slices.Contains(id.Opcodes, op)
+}
+
+// Parse the text of an OP_IDENTIFY reply
+func parseIdentity(text string) NodeIdentity {
+	var id NodeIdentity
+	for _, field := range strings.Split(text, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok || key == "" {
+			continue
+		}
+		if id.Fields == nil {
+			id.Fields = make(map[string]string)
+		}
+		id.Fields[key] = value
+		switch key {
+		case "Software":
+			id.Software = value
+		case "Ops":
+			id.Opcodes = make([]uint16, 0)
+			for _, op := range strings.Split(value, ":") {
+				n, err := strconv.ParseUint(op, 10, 16)
+				if err == nil {
+					id.Opcodes = append(id.Opcodes, uint16(n))
+				}
+			}
+		}
+	}
+	return id
+}
+
+// Format an identity as the text of an OP_IDENTIFY reply
+func formatIdentity(id NodeIdentity) string {
+	fields := make([]string, 0)
+	if id.Software != "" {
+		fields = append(fields, "Software="+id.Software)
+	}
+	if id.Opcodes != nil {
+		ops := make([]string, len(id.Opcodes))
+		for i, op := range id.Opcodes {
+			ops[i] = strconv.Itoa(int(op))
+		}
+		fields = append(fields, "Ops="+strings.Join(ops, ":"))
+	}
+	for key, value := range id.Fields {
+		if key != "Software" && key != "Ops" {
+			fields = append(fields, key+"="+value)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+// Ask every node of the table for its identity, n at a time, and keep
+// the answers in the node table. Nodes that fail keep their last identity.
+// Each node has the time of one attempt to answer, a cancelled ctx stops
+// the sweep and is returned.
+func (c *Client) IdentifyNodes(ctx context.Context, n int) error {
+	c.mu.RLock()
+	nodes := make([]string, 0, len(c.settings.Nodes))
+	for _, node := range c.settings.Nodes {
+		nodes = append(nodes, node.IP)
+	}
+	c.mu.RUnlock()
+
+	if n <= 0 {
+		n = 1
+	}
+	timeout := c.attemptTimeout()
+
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for _, ip := range nodes {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			node_ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			identity, err := queryNode(node_ctx, c, RemoteNode{IP: ip}, func(ctx context.Context, sd *SocketData) (NodeIdentity, error) {
+				return sd.Identify(ctx)
+			})
+			if err != nil {
+				c.log().Warn("identify failed", "node", ip, "err", err)
+				return
+			}
+			c.setNodeIdentity(ip, identity)
+		}(ip)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// Store the identity of the node ip
+func (c *Client) setNodeIdentity(ip string, identity NodeIdentity) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.settings.Nodes {
+		if c.settings.Nodes[i].IP == ip {
+			// replaced and never modified, so that Settings copies can share it
+			c.settings.Nodes[i].Identity = &identity
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package mcminterface
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseIdentity(t *testing.T) {
+	id := NodeIdentity{
+		Software: "mockd/1.0",
+		Opcodes:  []uint16{OP_BALANCE, OP_IDENTIFY},
+		Fields:   map[string]string{"Mfee": "500"},
+	}
+	parsed := parseIdentity(formatIdentity(id))
+	if parsed.Software != id.Software || !reflect.DeepEqual(parsed.Opcodes, id.Opcodes) || parsed.Fields["Mfee"] != "500" {
+		t.Errorf("parsed %+v, want %+v", parsed, id)
+	}
+
+	// Malformed fields are skipped
+	parsed = parseIdentity("junk,=x, Software=a ,Ops=3:x:20")
+	if parsed.Software != "a" || !reflect.DeepEqual(parsed.Opcodes, []uint16{3, 20}) {
+		t.Errorf("parsed %+v", parsed)
+	}
+}
+
+func TestNodeIdentitySupports(t *testing.T) {
+	var unknown *NodeIdentity
+	partial := &NodeIdentity{Opcodes: []uint16{OP_BALANCE}}
+	if !unknown.Supports(OP_RESOLVE) || unknown.Supports(LAST_OP+1) {
+		t.Error("a nil identity must serve the opcodes of the protocol only")
+	}
+	if !partial.Supports(OP_BALANCE) || partial.Supports(OP_RESOLVE) {
+		t.Error("an identity with an opcode list must serve the listed opcodes only")
+	}
+	if !partial.Supports(OP_HELLO) {
+		t.Error("the handshake must always be served")
+	}
+}
+
+func TestIdentifyNodes(t *testing.T) {
+	full_id := NodeIdentity{
+		Capabilities: CapSanctuary | CapMfee,
+		Software:     "mockd/1.0",
+		Fields:       map[string]string{"Mfee": "500"},
+	}
+	// A node that cannot resolve tags
+	partial_id := NodeIdentity{Software: "mockd/0.9", Opcodes: []uint16{OP_BALANCE, OP_IDENTIFY}}
+	_, full := startMockNodes(t, 1, func(node *MockNode) { node.SetIdentity(full_id) })
+	_, partial := startMockNodes(t, 1, func(node *MockNode) { node.SetIdentity(partial_id) })
+
+	path := filepath.Join(t.TempDir(), "settings.json")
+	err := SaveSettings(path, SettingsType{Nodes: []RemoteNode{
+		{IP: full[0], Ping: 10, LastSeen: time.Now()},
+		{IP: partial[0], Ping: 10, LastSeen: time.Now()},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(WithSettingsPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without identities every node is a candidate
+	if nodes := client.PickNodes(2, OP_RESOLVE); len(nodes) != 2 {
+		t.Errorf("%d unidentified nodes picked, want 2", len(nodes))
+	}
+	if err := client.IdentifyNodes(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SaveSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The identities are persisted
+	settings, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range settings.Nodes {
+		id := node.Identity
+		switch {
+		case id == nil:
+			t.Errorf("%s has no identity", node.IP)
+		case node.IP == full[0] && (id.Software != "mockd/1.0" || id.Capabilities != CapSanctuary|CapMfee ||
+			id.Fields["Mfee"] != "500" || id.Version != PVERSION || !id.Supports(OP_RESOLVE)):
+			t.Errorf("%s is %+v", node.IP, *id)
+		case node.IP == partial[0] && (id.Software != "mockd/0.9" || id.Supports(OP_RESOLVE) || !id.Supports(OP_BALANCE)):
+			t.Errorf("%s is %+v", node.IP, *id)
+		}
+	}
+
+	// Only the full node serves OP_RESOLVE
+	client, err = NewClient(WithSettingsPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := client.PickNodes(2, OP_RESOLVE); len(nodes) != 1 || nodes[0].IP != full[0] {
+		t.Errorf("picked %v for OP_RESOLVE, want %s only", nodes, full[0])
+	}
+	if nodes := client.PickNodes(2, OP_BALANCE); len(nodes) != 2 {
+		t.Errorf("%d nodes picked for OP_BALANCE, want 2", len(nodes))
+	}
+}
@@ -0,0 +1,99 @@
+package mcminterface
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Default connection limits of a Client
+const (
+	DEFAULT_NODE_RATE_LIMIT = 2.0 // connections per second to a single node
+	DEFAULT_NODE_RATE_BURST = 5   // connections to a single node allowed at once
+	DEFAULT_MAX_CONNECTIONS = 32  // concurrent connections of a client
+)
+
+// Token bucket of a node
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limits the connections of a Client: a token bucket per node entry for
+// the rate, and a semaphore for the connections open at the same time.
+// A negative rate or max disables the matching limit.
+type connLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*tokenBucket
+	slots   chan struct{}
+}
+
+func newConnLimiter(rate float64, burst int, max int) *connLimiter {
+	l := &connLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// Take a token of node, returning how long to wait before using it
+func (l *connLimiter) reserve(node string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bucket := l.buckets[node]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[node] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > float64(l.burst) {
+		bucket.tokens = float64(l.burst)
+	}
+	bucket.last = now
+	// tokens may go negative: later callers queue behind this one
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / l.rate * float64(time.Second))
+}
+
+// Give back a token that was reserved but not used
+func (l *connLimiter) cancel(node string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bucket := l.buckets[node]; bucket != nil {
+		bucket.tokens++
+	}
+}
+
+// Wait until a connection to node is allowed. The returned function
+// must be called once the connection is closed.
+func (l *connLimiter) wait(ctx context.Context, node string) (func(), error) {
+	if l.rate > 0 {
+		if delay := l.reserve(node); delay > 0 {
+			if err := sleepContext(ctx, delay); err != nil {
+				l.cancel(node)
+				return nil, err
+			}
+		}
+	}
+	if l.slots == nil {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return func() { <-l.slots }, nil
+}
@@ -0,0 +1,137 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	// burst of 2 then 10 connections per second
+	l := newConnLimiter(10, 2, -1)
+	for i := 0; i < 2; i++ {
+		if delay := l.reserve("node"); delay != 0 {
+			t.Fatalf("connection %d of the burst delayed by %v", i+1, delay)
+		}
+	}
+	delay := l.reserve("node")
+	if delay <= 0 || delay > 100*time.Millisecond {
+		t.Errorf("connection after the burst delayed by %v, want up to 100ms", delay)
+	}
+	// the next one queues behind it
+	if next := l.reserve("node"); next <= delay {
+		t.Errorf("queued connection delayed by %v, not after %v", next, delay)
+	}
+	// buckets are per node
+	if delay := l.reserve("other"); delay != 0 {
+		t.Errorf("connection to another node delayed by %v", delay)
+	}
+}
+
+func TestLimiterCancelledWait(t *testing.T) {
+	l := newConnLimiter(0.1, 1, -1)
+	release, err := l.wait(context.Background(), "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.wait(ctx, "node"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	// the token of the cancelled wait is given back: the next connection
+	// waits for one token at 0.1 per second, not two
+	if delay := l.reserve("node"); delay > 10*time.Second {
+		t.Errorf("connection delayed by %v after a cancelled wait, want up to 10s", delay)
+	}
+}
+
+func TestLimiterMaxConnections(t *testing.T) {
+	l := newConnLimiter(-1, 0, 1)
+	release, err := l.wait(context.Background(), "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the only slot is taken
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.wait(ctx, "other"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v with no free slot, want context.Canceled", err)
+	}
+	release()
+	release, err = l.wait(context.Background(), "other")
+	if err != nil {
+		t.Fatalf("slot not given back: %v", err)
+	}
+	release()
+
+	// without limits nothing waits
+	l = newConnLimiter(-1, 0, -1)
+	for i := 0; i < 10; i++ {
+		if _, err := l.wait(context.Background(), "node"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClientLimits(t *testing.T) {
+	address := randomAddress()
+	_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetBalance(address, 1000)
+	})
+	client := newMockClient(t, addrs, WithRateLimit(100, 2), WithMaxConnections(1))
+
+	// Concurrent queries share the single connection slot
+	errs := make([]error, 6)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.QueryBalance(context.Background(), hex.EncodeToString(address[:]))
+		}(i)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+
+	// A slow rate cannot be waited for past the context deadline
+	client = newMockClient(t, addrs, WithRateLimit(0.1, 1))
+	if _, err := client.QueryBalance(context.Background(), hex.EncodeToString(address[:])); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.QueryBalance(ctx, hex.EncodeToString(address[:]))
+	if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+}
+
+func TestBenchmarkNodesRateLimited(t *testing.T) {
+	_, addrs := startMockNodes(t, 1, nil)
+	client := newTableClient(t, addrs, WithRateLimit(3, 1))
+	ctx := context.Background()
+
+	// The second benchmark waits a third of a second for the node,
+	// the wait is not part of the ping
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := client.BenchmarkNodes(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("benchmarks took %v, the rate limit did not apply", elapsed)
+	}
+	nodes := client.Settings().Nodes
+	if len(nodes) != 1 || nodes[0].Ping >= 50 {
+		t.Errorf("node table %v, want a ping under 50ms", nodes)
+	}
+}
@@ -0,0 +1,46 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+)
+
+// Handler dropping every record, the default of the library
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Logger used when none is configured
+var discard_logger = slog.New(discardHandler{})
+
+// Get the logger of the socket, silent if none is set
+func (m *SocketData) logger() *slog.Logger {
+	if m.Logger == nil {
+		return discard_logger
+	}
+	return m.Logger
+}
+
+// Log a frame at debug level with its node, opcode and IDs.
+// Attributes are only built when debug is enabled, frames are a hot path.
+func (m *SocketData) logFrame(msg string, tx *TX, err error) {
+	logger := m.logger()
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("node", m.IP),
+		slog.String("op", OpcodeName(binary.LittleEndian.Uint16(tx.Opcode[:]))),
+		slog.String("id1", hex.EncodeToString(tx.ID1[:])),
+		slog.String("id2", hex.EncodeToString(tx.ID2[:])),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.Any("err", err))
+	}
+	logger.LogAttrs(context.Background(), slog.LevelDebug, msg, attrs...)
+}
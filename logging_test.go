@@ -0,0 +1,103 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// Handler keeping every record, at every level
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, record slog.Record) error {
+	h.mu.Lock()
+	h.records = append(h.records, record.Clone())
+	h.mu.Unlock()
+	return nil
+}
+
+// Get the attribute keys of the captured records with message msg
+func (h *captureHandler) keys(msg string) []map[string]bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []map[string]bool
+	for _, record := range h.records {
+		if record.Message != msg {
+			continue
+		}
+		keys := make(map[string]bool)
+		record.Attrs(func(attr slog.Attr) bool {
+			keys[attr.Key] = true
+			return true
+		})
+		found = append(found, keys)
+	}
+	return found
+}
+
+func (h *captureHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.records)
+}
+
+func TestClientLogger(t *testing.T) {
+	address := randomAddress()
+	_, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetBalance(address, 1000)
+	})
+	handler := &captureHandler{}
+	client := newMockClient(t, addrs, WithLogger(slog.New(handler)))
+	if _, err := client.QueryBalance(context.Background(), hex.EncodeToString(address[:])); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]string{
+		"sent":          {"node", "op", "id1", "id2"},
+		"received":      {"node", "op", "id1", "id2"},
+		"connected":     {"node", "address", "duration"},
+		"node answered": {"node", "attempts", "duration"},
+	}
+	for msg, want := range tests {
+		records := handler.keys(msg)
+		if len(records) == 0 {
+			t.Errorf("no %q record", msg)
+			continue
+		}
+		for _, keys := range records {
+			for _, key := range want {
+				if !keys[key] {
+					t.Errorf("%q record without %s: %v", msg, key, keys)
+				}
+			}
+		}
+	}
+}
+
+func TestClientWithoutLogger(t *testing.T) {
+	handler := &captureHandler{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	defer slog.SetDefault(previous)
+
+	address := randomAddress()
+	_, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetBalance(address, 1000)
+	})
+	client := newMockClient(t, addrs)
+	if _, err := client.QueryBalance(context.Background(), hex.EncodeToString(address[:])); err != nil {
+		t.Fatal(err)
+	}
+	if n := handler.count(); n != 0 {
+		t.Errorf("%d records logged without a logger", n)
+	}
+}
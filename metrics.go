@@ -0,0 +1,274 @@
+package mcminterface
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the operation latency histogram buckets
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Label of a sample
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one value of a metric family. Histograms are flattened into
+// their _bucket, _sum and _count samples like in the Prometheus text format.
+type Sample struct {
+	Name   string
+	Labels []Label
+	Value  float64
+}
+
+// MetricFamily groups the samples of a metric
+type MetricFamily struct {
+	Name    string
+	Help    string
+	Type    string // counter, gauge or histogram
+	Samples []Sample
+}
+
+// Collector returns a snapshot of its metrics
+type Collector interface {
+	Collect() []MetricFamily
+}
+
+// Histogram of operation latencies
+type latency struct {
+	counts []uint64 // per bucket, not cumulative, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+type opKey struct {
+	node string
+	op   uint16
+	ok   bool
+}
+
+type frameErrorKey struct {
+	node   string
+	reason string
+}
+
+// Metrics counts node operations, frame failures and quorum failures.
+// Set it on SocketData.Metrics or on a Client with WithMetrics, a nil
+// Metrics records nothing. It is safe for concurrent use.
+type Metrics struct {
+	mu              sync.Mutex
+	buckets         []float64
+	ops             map[opKey]uint64
+	latencies       map[opKey]*latency // ok is always false
+	frame_errors    map[frameErrorKey]uint64
+	quorum_failures map[string]uint64
+}
+
+// Create Metrics with DefaultLatencyBuckets
+func NewMetrics() *Metrics {
+	return &Metrics{
+		buckets:         DefaultLatencyBuckets,
+		ops:             make(map[opKey]uint64),
+		latencies:       make(map[opKey]*latency),
+		frame_errors:    make(map[frameErrorKey]uint64),
+		quorum_failures: make(map[string]uint64),
+	}
+}
+
+// Record an operation on node, identified by the opcode of its request
+func (m *Metrics) observeOp(node string, op uint16, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ops[opKey{node: node, op: op, ok: err == nil}]++
+
+	key := opKey{node: node, op: op}
+	hist := m.latencies[key]
+	if hist == nil {
+		hist = &latency{counts: make([]uint64, len(m.buckets)+1)}
+		m.latencies[key] = hist
+	}
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(m.buckets, seconds)
+	hist.counts[i]++
+	hist.sum += seconds
+	hist.count++
+}
+
+// Record a received frame rejected by the checks of recvTX
+func (m *Metrics) observeFrameError(node string, err error) {
+	if m == nil {
+		return
+	}
+	var reason string
+	var frame_err *FrameError
+	switch {
+	case errors.Is(err, ErrChecksum):
+		reason = "crc"
+	case errors.Is(err, ErrBadTrailer):
+		reason = "trailer"
+	case errors.Is(err, ErrShortRead):
+		reason = "short_read"
+	case errors.As(err, &frame_err):
+		reason = strings.ToLower(frame_err.Field)
+	default:
+		return
+	}
+	m.mu.Lock()
+	m.frame_errors[frameErrorKey{node: node, reason: reason}]++
+	m.mu.Unlock()
+}
+
+// Record a query without quorum
+func (m *Metrics) observeQuorumFailure(query string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.quorum_failures[query]++
+	m.mu.Unlock()
+}
+
+// Get a snapshot of the metrics
+func (m *Metrics) Collect() []MetricFamily {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ops := MetricFamily{Name: "mcm_operations_total", Help: "Node operations by node, request opcode and result.", Type: "counter"}
+	for key, count := range m.ops {
+		result := "error"
+		if key.ok {
+			result = "ok"
+		}
+		ops.Samples = append(ops.Samples, Sample{
+			Name:   ops.Name,
+			Labels: []Label{{"node", key.node}, {"op", OpcodeName(key.op)}, {"result", result}},
+			Value:  float64(count),
+		})
+	}
+
+	durations := MetricFamily{Name: "mcm_operation_duration_seconds", Help: "Latency of node operations by node and request opcode.", Type: "histogram"}
+	for key, hist := range m.latencies {
+		labels := []Label{{"node", key.node}, {"op", OpcodeName(key.op)}}
+		var cumulative uint64
+		for i, count := range hist.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(m.buckets) {
+				le = m.buckets[i]
+			}
+			durations.Samples = append(durations.Samples, Sample{
+				Name:   durations.Name + "_bucket",
+				Labels: append(labels[:len(labels):len(labels)], Label{"le", formatFloat(le)}),
+				Value:  float64(cumulative),
+			})
+		}
+		durations.Samples = append(durations.Samples,
+			Sample{Name: durations.Name + "_sum", Labels: labels, Value: hist.sum},
+			Sample{Name: durations.Name + "_count", Labels: labels, Value: float64(hist.count)},
+		)
+	}
+
+	frames := MetricFamily{Name: "mcm_frame_errors_total", Help: "Received frames rejected by node and reason.", Type: "counter"}
+	for key, count := range m.frame_errors {
+		frames.Samples = append(frames.Samples, Sample{
+			Name:   frames.Name,
+			Labels: []Label{{"node", key.node}, {"reason", key.reason}},
+			Value:  float64(count),
+		})
+	}
+
+	quorum := MetricFamily{Name: "mcm_quorum_failures_total", Help: "Queries where no result reached quorum.", Type: "counter"}
+	for query, count := range m.quorum_failures {
+		quorum.Samples = append(quorum.Samples, Sample{Name: quorum.Name, Labels: []Label{{"query", query}}, Value: float64(count)})
+	}
+
+	families := []MetricFamily{ops, durations, frames, quorum}
+	for i := range families {
+		sortSamples(families[i].Samples)
+	}
+	return families
+}
+
+// Sort samples by name and labels, for a stable output
+func sortSamples(samples []Sample) {
+	key := func(s Sample) string {
+		var b strings.Builder
+		for _, label := range s.Labels {
+			if label.Name == "le" {
+				continue
+			}
+			b.WriteString(label.Value)
+			b.WriteByte(0)
+		}
+		return b.String()
+	}
+	// stable to keep the buckets, _sum and _count of a histogram in order
+	sort.SliceStable(samples, func(i, j int) bool {
+		return key(samples[i]) < key(samples[j])
+	})
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Escape a label value for the text format
+var label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write the metrics of collectors in the Prometheus text format
+func WriteMetrics(w io.Writer, collectors ...Collector) error {
+	bw := bufio.NewWriter(w)
+	for _, collector := range collectors {
+		for _, family := range collector.Collect() {
+			fmt.Fprintf(bw, "# HELP %s %s\n", family.Name, family.Help)
+			fmt.Fprintf(bw, "# TYPE %s %s\n", family.Name, family.Type)
+			for _, sample := range family.Samples {
+				bw.WriteString(sample.Name)
+				if len(sample.Labels) > 0 {
+					bw.WriteByte('{')
+					for i, label := range sample.Labels {
+						if i > 0 {
+							bw.WriteByte(',')
+						}
+						fmt.Fprintf(bw, `%s="%s"`, label.Name, label_escaper.Replace(label.Value))
+					}
+					bw.WriteByte('}')
+				}
+				bw.WriteByte(' ')
+				bw.WriteString(formatFloat(sample.Value))
+				bw.WriteByte('\n')
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// HTTP handler serving the metrics of collectors, to be mounted on /metrics
+func MetricsHandler(collectors ...Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w, collectors...)
+	})
+}
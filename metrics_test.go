@@ -0,0 +1,74 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	address := randomAddress()
+	nodes, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetBalance(address, 1000)
+	})
+	client := newMockClient(t, addrs, WithMetrics(NewMetrics()))
+	ctx := context.Background()
+
+	if _, err := client.QueryBalance(ctx, hex.EncodeToString(address[:])); err != nil {
+		t.Fatal(err)
+	}
+	// Three different balances cannot reach quorum
+	for i, node := range nodes {
+		node.SetBalance(address, uint64(2000+i))
+	}
+	if _, err := client.QueryBalance(ctx, hex.EncodeToString(address[:])); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("got %v, want ErrNoQuorum", err)
+	}
+
+	server := httptest.NewServer(MetricsHandler(client))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	text := string(body)
+
+	expected := []string{
+		"# TYPE mcm_operation_duration_seconds histogram",
+		fmt.Sprintf(`mcm_operations_total{node="%s",op="OP_HELLO",result="ok"} 2`, addrs[0]),
+		fmt.Sprintf(`mcm_operations_total{node="%s",op="OP_BALANCE",result="ok"} 2`, addrs[1]),
+		fmt.Sprintf(`mcm_operation_duration_seconds_bucket{node="%s",op="OP_BALANCE",le="+Inf"} 2`, addrs[2]),
+		fmt.Sprintf(`mcm_operation_duration_seconds_count{node="%s",op="OP_BALANCE"} 2`, addrs[2]),
+		`mcm_quorum_failures_total{query="balance"} 1`,
+		"mcm_nodes 0",
+	}
+	for _, line := range expected {
+		if !strings.Contains(text, line) {
+			t.Errorf("missing metric %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(text)
+	}
+}
+
+func TestWriteMetricsEscaping(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.observeQuorumFailure("a \"quoted\"\nquery\\")
+	var b strings.Builder
+	if err := WriteMetrics(&b, metrics); err != nil {
+		t.Fatal(err)
+	}
+	want := `mcm_quorum_failures_total{query="a \"quoted\"\nquery\\"} 1`
+	if !strings.Contains(b.String(), want) {
+		t.Errorf("missing %s in\n%s", want, b.String())
+	}
+}
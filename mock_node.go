@@ -0,0 +1,410 @@
+package mcminterface
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// MockNode is an in-process MCM node speaking the real framing, backed by
+// an in-memory ledger and block set. It answers OP_HELLO, OP_GET_IPL,
+// OP_BALANCE, OP_RESOLVE, OP_GET_BLOCK, OP_GET_TFILE, OP_TF, OP_HASH,
+// OP_IDENTIFY and OP_TX, anything else gets OP_NACK.
+type MockNode struct {
+	mu       sync.Mutex
+	listener net.Listener
+	wg       sync.WaitGroup
+	conns    map[net.Conn]bool
+	closed   bool
+
+	tip      NodeTip
+	ledger   map[[TXADDRLEN]byte]uint64
+	blocks   map[uint64][]byte
+	trailers []BTRAILER
+	peers    []string
+	busy     int
+	identity NodeIdentity
+	txs      []Transaction
+	tx_ack   bool
+}
+
+// Create a mock node, Start makes it listen
+func NewMockNode() *MockNode {
+	return &MockNode{
+		conns:  make(map[net.Conn]bool),
+		ledger: make(map[[TXADDRLEN]byte]uint64),
+		blocks: make(map[uint64][]byte),
+		tx_ack: true,
+	}
+}
+
+// Set the block number announced in the handshake
+func (n *MockNode) SetBlockNum(block_num uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tip.Block = block_num
+}
+
+// Set the chain tip announced in the handshake
+func (n *MockNode) SetTip(tip NodeTip) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tip = tip
+}
+
+// Set the balance of an address, its tag is the last TXTAGLEN bytes
+func (n *MockNode) SetBalance(address [TXADDRLEN]byte, balance uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ledger[address] = balance
+}
+
+// Set the content of block block_num
+func (n *MockNode) SetBlock(block_num uint64, data []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.blocks[block_num] = append([]byte(nil), data...)
+}
+
+// Set the trailers of the chain, served by OP_GET_TFILE, OP_TF and OP_HASH
+func (n *MockNode) SetTrailers(trailers []BTRAILER) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.trailers = append([]BTRAILER(nil), trailers...)
+}
+
+// Set the IPv4 addresses returned by OP_GET_IPL
+func (n *MockNode) SetPeers(ips ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.peers = append([]string(nil), ips...)
+}
+
+// Reply OP_BUSY to the next count handshakes
+func (n *MockNode) SetBusy(count int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.busy = count
+}
+
+// Set the identity reported to OP_IDENTIFY. The version, if not 0, and the
+// capabilities are sent in every frame, and with an opcode list the other
+// requests get OP_NACK.
+func (n *MockNode) SetIdentity(identity NodeIdentity) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.identity = identity
+}
+
+// Set if accepted transactions are acknowledged by echoing OP_TX, or if
+// the connection is closed without a reply
+func (n *MockNode) SetTxAck(ack bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tx_ack = ack
+}
+
+// Get the transactions accepted with OP_TX
+func (n *MockNode) Transactions() []Transaction {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Transaction(nil), n.txs...)
+}
+
+// Listen on address, such as "127.0.0.1:0", and serve in the background
+func (n *MockNode) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.listener = listener
+	n.mu.Unlock()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			if n.closed {
+				n.mu.Unlock()
+				conn.Close()
+				return
+			}
+			n.conns[conn] = true
+			n.mu.Unlock()
+
+			n.wg.Add(1)
+			go func() {
+				defer n.wg.Done()
+				n.serve(conn)
+				n.mu.Lock()
+				delete(n.conns, conn)
+				n.mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+	return nil
+}
+
+// Get the host:port the node listens on
+func (n *MockNode) Addr() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.listener == nil {
+		return ""
+	}
+	return n.listener.Addr().String()
+}
+
+// Stop listening, close the open connections and wait for them
+func (n *MockNode) Close() error {
+	n.mu.Lock()
+	n.closed = true
+	var err error
+	if n.listener != nil {
+		err = n.listener.Close()
+	}
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.mu.Unlock()
+	n.wg.Wait()
+	return err
+}
+
+// Read and check a frame from conn
+func mockRecv(conn net.Conn, tx *TX) error {
+	frame := frame_pool.Get().(*[TX_LEN]byte)
+	defer frame_pool.Put(frame)
+	_, err := io.ReadFull(conn, frame[:])
+	if err != nil {
+		return err
+	}
+	if frameCRC16(frame[:]) != binary.LittleEndian.Uint16(frame[TX_CRC_LEN:]) {
+		return ErrChecksum
+	}
+	return tx.UnmarshalBinary(frame[:])
+}
+
+// Set the opcode and crc16 of tx and write it to conn
+func mockSend(conn net.Conn, tx *TX, op uint16) error {
+	binary.LittleEndian.PutUint16(tx.Opcode[:], op)
+	tx.computeCRC16()
+	frame := frame_pool.Get().(*[TX_LEN]byte)
+	defer frame_pool.Put(frame)
+	buf, _ := tx.AppendBinary(frame[:0])
+	_, err := conn.Write(buf)
+	return err
+}
+
+// Serve one connection: handshake, one request, close
+func (n *MockNode) serve(conn net.Conn) {
+	var hello TX
+	if mockRecv(conn, &hello) != nil {
+		return
+	}
+	if binary.LittleEndian.Uint16(hello.Opcode[:]) != OP_HELLO {
+		return
+	}
+
+	// Reply with our session IDs, echoing ID1
+	reply := NewTX(nil)
+	reply.ID1 = hello.ID1
+	rand.Read(reply.ID2[:])
+	n.mu.Lock()
+	n.tip.put(&reply)
+	if n.identity.Version != 0 {
+		reply.Version[0] = n.identity.Version
+	}
+	reply.Version[1] = byte(n.identity.Capabilities)
+	identity := n.identity
+	busy := n.busy > 0
+	if busy {
+		n.busy--
+	}
+	n.mu.Unlock()
+	if busy {
+		mockSend(conn, &reply, OP_BUSY)
+		return
+	}
+	if mockSend(conn, &reply, OP_HELLO_ACK) != nil {
+		return
+	}
+
+	var request TX
+	if mockRecv(conn, &request) != nil {
+		return
+	}
+	if request.ID1 != reply.ID1 || request.ID2 != reply.ID2 {
+		return
+	}
+	// Keep the session IDs and block number, clear the rest
+	session := reply
+	reply = NewTX(nil)
+	reply.ID1, reply.ID2, reply.Cblock = session.ID1, session.ID2, session.Cblock
+	reply.Version = session.Version
+
+	op := binary.LittleEndian.Uint16(request.Opcode[:])
+	if !identity.Supports(op) {
+		mockSend(conn, &reply, OP_NACK)
+		return
+	}
+	switch op {
+	case OP_GET_IPL:
+		n.mu.Lock()
+		length := 0
+		for _, peer := range n.peers {
+			ip := net.ParseIP(peer).To4()
+			if ip == nil || length+4 > TXADDRLEN {
+				continue
+			}
+			length += copy(reply.Src_addr[length:], ip)
+		}
+		n.mu.Unlock()
+		binary.LittleEndian.PutUint16(reply.Len[:], uint16(length))
+		mockSend(conn, &reply, OP_SEND_IPL)
+
+	case OP_BALANCE:
+		n.mu.Lock()
+		balance, ok := n.ledger[request.Src_addr]
+		n.mu.Unlock()
+		reply.Src_addr = request.Src_addr
+		if ok {
+			binary.LittleEndian.PutUint64(reply.Send_total[:], balance)
+			reply.Change_total[0] = 1
+		}
+		mockSend(conn, &reply, OP_SEND_BAL)
+
+	case OP_RESOLVE:
+		tag := request.Dst_addr[TXADDRLEN-TXTAGLEN:]
+		n.mu.Lock()
+		for address, balance := range n.ledger {
+			if string(address[TXADDRLEN-TXTAGLEN:]) == string(tag) {
+				reply.Dst_addr = address
+				reply.Send_total[0] = 1
+				binary.LittleEndian.PutUint64(reply.Change_total[:], balance)
+				break
+			}
+		}
+		n.mu.Unlock()
+		mockSend(conn, &reply, OP_RESOLVE)
+
+	case OP_GET_BLOCK:
+		n.mu.Lock()
+		block, ok := n.blocks[binary.LittleEndian.Uint64(request.Blocknum[:])]
+		n.mu.Unlock()
+		if !ok {
+			mockSend(conn, &reply, OP_NACK)
+			return
+		}
+		n.sendFile(conn, &reply, block)
+
+	case OP_GET_TFILE:
+		n.mu.Lock()
+		tfile := make([]byte, 0, len(n.trailers)*BTRAILER_LEN)
+		for i := range n.trailers {
+			data, _ := n.trailers[i].MarshalBinary()
+			tfile = append(tfile, data...)
+		}
+		n.mu.Unlock()
+		n.sendFile(conn, &reply, tfile)
+
+	case OP_TF:
+		start := uint64(binary.LittleEndian.Uint32(request.Blocknum[:4]))
+		count := int(binary.LittleEndian.Uint32(request.Blocknum[4:]))
+		n.mu.Lock()
+		tfile := make([]byte, 0)
+		for i := range n.trailers {
+			if bnum := n.trailers[i].BlockNum(); bnum >= start && bnum < start+uint64(count) {
+				data, _ := n.trailers[i].MarshalBinary()
+				tfile = append(tfile, data...)
+			}
+		}
+		n.mu.Unlock()
+		if len(tfile) == 0 {
+			mockSend(conn, &reply, OP_NACK)
+			return
+		}
+		n.sendFile(conn, &reply, tfile)
+
+	case OP_HASH:
+		bnum := binary.LittleEndian.Uint64(request.Blocknum[:])
+		found := false
+		n.mu.Lock()
+		for i := range n.trailers {
+			if n.trailers[i].BlockNum() == bnum {
+				reply.Cblockhash = n.trailers[i].Bhash
+				found = true
+				break
+			}
+		}
+		n.mu.Unlock()
+		if !found {
+			mockSend(conn, &reply, OP_NACK)
+			return
+		}
+		reply.Blocknum = request.Blocknum
+		mockSend(conn, &reply, OP_HASH)
+
+	case OP_TX:
+		// Like a node, accept a transaction spending the whole known balance
+		var tx Transaction
+		tx.get(&request)
+		n.mu.Lock()
+		balance, ok := n.ledger[tx.Src_addr]
+		total := tx.Send_total + tx.Change_total + tx.Tx_fee
+		accepted := ok && total == balance && total >= tx.Send_total
+		if accepted {
+			n.txs = append(n.txs, tx)
+		}
+		ack := n.tx_ack
+		n.mu.Unlock()
+		if !accepted {
+			mockSend(conn, &reply, OP_NACK)
+			return
+		}
+		if ack {
+			mockSend(conn, &reply, OP_TX)
+		}
+
+	case OP_IDENTIFY:
+		text := formatIdentity(identity)
+		length := copy(reply.Src_addr[:], text)
+		binary.LittleEndian.PutUint16(reply.Len[:], uint16(length))
+		mockSend(conn, &reply, OP_IDENTIFY)
+
+	default:
+		mockSend(conn, &reply, OP_NACK)
+	}
+}
+
+// Send data in OP_SEND_FILE frames, the end of file is the connection close
+func (n *MockNode) sendFile(conn net.Conn, reply *TX, data []byte) error {
+	for len(data) > 0 {
+		frame := data
+		if len(frame) > TX_BUFFER_LEN {
+			frame = frame[:TX_BUFFER_LEN]
+		}
+		data = data[len(frame):]
+
+		// The payload spans Src_addr to Tx_sig
+		var buf [TX_BUFFER_LEN]byte
+		copy(buf[:], frame)
+		fields := reply.fields()
+		decodeFields("OP_SEND_FILE payload", buf[:], fields[11:18]...)
+		binary.LittleEndian.PutUint16(reply.Len[:], uint16(len(frame)))
+		err := mockSend(conn, reply, OP_SEND_FILE)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
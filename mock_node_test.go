@@ -0,0 +1,206 @@
+package mcminterface
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// Start n mock nodes prepared by setup, they are closed when the test ends
+func startMockNodes(t *testing.T, n int, setup func(*MockNode)) ([]*MockNode, []string) {
+	t.Helper()
+	nodes := make([]*MockNode, n)
+	addrs := make([]string, n)
+	for i := range nodes {
+		node := NewMockNode()
+		if setup != nil {
+			setup(node)
+		}
+		if err := node.Start("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		nodes[i], addrs[i] = node, node.Addr()
+	}
+	return nodes, addrs
+}
+
+// Create a client that queries all of addrs and nothing else
+func newMockClient(t *testing.T, addrs []string, opts ...Option) *Client {
+	t.Helper()
+	opts = append([]Option{
+		WithStartIPs(addrs...),
+		WithQuerySize(len(addrs)),
+		WithForceQueryStartIPs(true),
+	}, opts...)
+	client, err := NewClient(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func randomAddress() [TXADDRLEN]byte {
+	var address [TXADDRLEN]byte
+	rand.Read(address[:])
+	return address
+}
+
+// Replace the port of addr with a host name
+func localhostAddr(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort("localhost", port)
+}
+
+func TestConnectToNode(t *testing.T) {
+	// A block spanning several OP_SEND_FILE frames
+	var block Block
+	block.Header.Hdrlen = BHEADER_LEN
+	block.Body = make([]TXQENTRY, 3)
+	rand.Read(block.Trailer.Bhash[:])
+	block_bytes, _ := block.MarshalBinary()
+
+	nodes, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetBlockNum(42)
+		node.SetBlock(42, block_bytes)
+	})
+	ctx := context.Background()
+
+	nodes[0].SetBusy(1)
+	if _, err := ConnectToNode(ctx, addrs[0]); !errors.Is(err, ErrNodeBusy) {
+		t.Fatalf("busy handshake: got %v, want ErrNodeBusy", err)
+	}
+
+	sd, err := ConnectToNode(ctx, addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	if sd.GetBlockNum() != 42 {
+		t.Errorf("block number %d, want 42", sd.GetBlockNum())
+	}
+	file, err := sd.GetBlockBytes(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file, block_bytes) {
+		t.Error("downloaded block differs")
+	}
+}
+
+func TestConnectToNodeHostName(t *testing.T) {
+	address := randomAddress()
+	_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetBalance(address, 1234567890)
+	})
+	ctx := context.Background()
+
+	// Host names are resolved at connect time
+	sd, err := ConnectToNode(ctx, localhostAddr(addrs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	wots_addr := WotsAddressFromBytes(address[:])
+	resolved, err := sd.ResolveTag(ctx, wots_addr.GetTAG())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Address != address || resolved.GetAmount() != 1234567890 {
+		t.Errorf("resolved %x with %d, want %x with 1234567890", resolved.Address, resolved.GetAmount(), address)
+	}
+}
+
+func TestClientQueryBalance(t *testing.T) {
+	address := randomAddress()
+	nodes, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetBalance(address, 1234567890)
+	})
+	client := newMockClient(t, addrs)
+	ctx := context.Background()
+
+	// the first handshake is refused, the query must retry
+	nodes[0].SetBusy(1)
+	balance, err := client.QueryBalance(ctx, hex.EncodeToString(address[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 1234567890 {
+		t.Errorf("balance %d, want 1234567890", balance)
+	}
+
+	var missing [TXADDRLEN]byte
+	if _, err := client.QueryBalance(ctx, hex.EncodeToString(missing[:])); !errors.Is(err, ErrAddressNotFound) {
+		t.Errorf("missing address: got %v, want ErrAddressNotFound", err)
+	}
+
+	// Malformed addresses are rejected before any node is asked
+	if _, err := client.QueryBalance(ctx, "not hex at all"); !errors.Is(err, hex.InvalidByteError('n')) {
+		t.Errorf("invalid hex: got %v, want hex.InvalidByteError", err)
+	}
+	var length_err *LengthError
+	if _, err := client.QueryBalance(ctx, hex.EncodeToString(address[:10])); !errors.As(err, &length_err) || length_err.Type != "address" || length_err.Received != 10 {
+		t.Errorf("short address: got %v, want a LengthError", err)
+	}
+}
+
+func TestClientExpandIPs(t *testing.T) {
+	_, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetPeers("10.0.0.1", "10.0.0.2")
+	})
+	client := newMockClient(t, addrs, WithExpandDepth(1))
+
+	if err := client.ExpandIPs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ips := client.Settings().IPs
+	for _, peer := range []string{"10.0.0.1", "10.0.0.2"} {
+		if !slices.Contains(ips, peer) {
+			t.Errorf("peer %s not found in %v", peer, ips)
+		}
+	}
+}
+
+func TestClientHostNameEntries(t *testing.T) {
+	_, addrs := startMockNodes(t, 3, nil)
+	hosts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		hosts[i] = localhostAddr(addr)
+	}
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := SaveSettings(path, SettingsType{IPs: hosts, QuerySize: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Host name entries keep their resolved address in the node table
+	// and are persisted as configured
+	client, err := NewClient(WithSettingsPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.BenchmarkNodes(context.Background(), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SaveSettings(); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := LoadSettings(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Nodes) != len(hosts) {
+		t.Fatalf("%d nodes in the table, want %d", len(settings.Nodes), len(hosts))
+	}
+	for _, node := range settings.Nodes {
+		host, _, _ := net.SplitHostPort(node.IP)
+		if host != "localhost" || node.Address == "" {
+			t.Errorf("entry %s resolved to %q", node.IP, node.Address)
+		}
+	}
+}
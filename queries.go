@@ -1,14 +1,25 @@
-package main
+package mcminterface
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
+	"time"
 )
 
 // Get IP list
-func (m *SocketData) GetIPList() ([]string, error) {
+func (m *SocketData) GetIPList(ctx context.Context) (ips []string, err error) {
+	done, err := m.begin(ctx, OP_GET_IPL, m.Timeouts.withDefaults().Op)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = done(err) }()
+
 	// Send OP_GET_IPL
-	err := m.SendOP(OP_GET_IPL)
+	err = m.SendOP(OP_GET_IPL)
 	if err != nil {
 		return nil, err
 	}
@@ -18,14 +29,16 @@ func (m *SocketData) GetIPList() ([]string, error) {
 		return nil, err
 	}
 	// Check if opcode is OP_SEND_IPL
-	if m.recv_tx.Opcode[0] != byte(OP_SEND_IPL) {
-		fmt.Println("Opcode:", m.recv_tx.Opcode)
-
-		return nil, (fmt.Errorf("opcode is not OP_SEND_IPL"))
+	err = m.expectOP(OP_SEND_IPL)
+	if err != nil {
+		return nil, err
 	}
 	// Read IP list from src_addr
-	var ips []string
-	for i := 0; i < int(m.recv_tx.Len[0]); i += 4 {
+	ipl_len := int(binary.LittleEndian.Uint16(m.recv_tx.Len[:]))
+	if ipl_len > TXADDRLEN {
+		return nil, &LengthError{Type: "IP list", Expected: TXADDRLEN, Received: ipl_len}
+	}
+	for i := 0; i+4 <= ipl_len; i += 4 {
 		ip := fmt.Sprintf("%d.%d.%d.%d", m.recv_tx.Src_addr[i], m.recv_tx.Src_addr[i+1], m.recv_tx.Src_addr[i+2], m.recv_tx.Src_addr[i+3])
 		ips = append(ips, ip)
 	}
@@ -33,7 +46,13 @@ func (m *SocketData) GetIPList() ([]string, error) {
 }
 
 // Resolve tag
-func (m *SocketData) ResolveTag(tag []byte) (WotsAddress, error) {
+func (m *SocketData) ResolveTag(ctx context.Context, tag []byte) (_ WotsAddress, err error) {
+	done, err := m.begin(ctx, OP_RESOLVE, m.Timeouts.withDefaults().Op)
+	if err != nil {
+		return WotsAddress{}, err
+	}
+	defer func() { err = done(err) }()
+
 	m.send_tx = NewTX(nil)
 	m.send_tx.ID1 = m.recv_tx.ID1
 	m.send_tx.ID2 = m.recv_tx.ID2
@@ -44,7 +63,7 @@ func (m *SocketData) ResolveTag(tag []byte) (WotsAddress, error) {
 	// Set the destination address
 	m.send_tx.Dst_addr = wots_addr.Address
 	// Send OP_RESOLVE
-	err := m.SendOP(OP_RESOLVE)
+	err = m.SendOP(OP_RESOLVE)
 	if err != nil {
 		return WotsAddress{}, err
 	}
@@ -54,14 +73,15 @@ func (m *SocketData) ResolveTag(tag []byte) (WotsAddress, error) {
 		return WotsAddress{}, err
 	}
 
-	// Check if opcode is OP_SEND_RESOLVE
-	if m.recv_tx.Opcode[0] != byte(OP_RESOLVE) {
-		return WotsAddress{}, (fmt.Errorf("opcode is not OP_RESOLVE"))
+	// Check if opcode is OP_RESOLVE
+	err = m.expectOP(OP_RESOLVE)
+	if err != nil {
+		return WotsAddress{}, err
 	}
 
 	// Check if send total is one, else tag not found
 	if m.recv_tx.Send_total[0] != 1 {
-		return WotsAddress{}, (fmt.Errorf("tag not found"))
+		return WotsAddress{}, ErrTagNotFound
 	}
 
 	// Copy the address
@@ -74,7 +94,13 @@ func (m *SocketData) ResolveTag(tag []byte) (WotsAddress, error) {
 }
 
 // Get balance of a WotsAddress
-func (m *SocketData) GetBalance(wots_addr WotsAddress) (uint64, error) {
+func (m *SocketData) GetBalance(ctx context.Context, wots_addr WotsAddress) (_ uint64, err error) {
+	done, err := m.begin(ctx, OP_BALANCE, m.Timeouts.withDefaults().Op)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = done(err) }()
+
 	m.send_tx = NewTX(nil)
 	m.send_tx.ID1 = m.recv_tx.ID1
 	m.send_tx.ID2 = m.recv_tx.ID2
@@ -83,7 +109,7 @@ func (m *SocketData) GetBalance(wots_addr WotsAddress) (uint64, error) {
 	m.send_tx.Src_addr = wots_addr.Address
 
 	// Send OP_GET_BALANCE
-	err := m.SendOP(OP_BALANCE)
+	err = m.SendOP(OP_BALANCE)
 	if err != nil {
 		return 0, err
 	}
@@ -93,22 +119,161 @@ func (m *SocketData) GetBalance(wots_addr WotsAddress) (uint64, error) {
 		return 0, err
 	}
 
-	// Check if opcode is OP_SEND_BALANCE
-	if m.recv_tx.Opcode[0] != byte(OP_SEND_BAL) {
-		return 0, (fmt.Errorf("opcode is not OP_SEND_BAL"))
+	// Check if opcode is OP_SEND_BAL
+	err = m.expectOP(OP_SEND_BAL)
+	if err != nil {
+		return 0, err
 	}
 
 	// Change total should be 1
 	if m.recv_tx.Change_total[0] != 1 {
-		return 0, (fmt.Errorf("address not found"))
+		return 0, ErrAddressNotFound
 	}
 
 	// Get the balance
 	return binary.LittleEndian.Uint64(m.recv_tx.Send_total[:]), nil
 }
 
+// Submit a signed transaction. The node acknowledges it by echoing OP_TX
+// and refuses it with OP_NACK (ErrTxRejected). A node closing the connection
+// without a reply may or may not have taken it (ErrTxUnconfirmed).
+func (m *SocketData) SubmitTransaction(ctx context.Context, tx Transaction) (err error) {
+	done, err := m.begin(ctx, OP_TX, m.Timeouts.withDefaults().Op)
+	if err != nil {
+		return err
+	}
+	defer func() { err = done(err) }()
+
+	m.send_tx = NewTX(nil)
+	m.send_tx.ID1 = m.recv_tx.ID1
+	m.send_tx.ID2 = m.recv_tx.ID2
+
+	// Fill the addresses, amounts and signature
+	tx.put(&m.send_tx)
+
+	// Send OP_TX
+	err = m.SendOP(OP_TX)
+	if err != nil {
+		return err
+	}
+
+	err = m.recvTX()
+	if err == io.EOF {
+		return ErrTxUnconfirmed
+	}
+	if err != nil {
+		return err
+	}
+	switch binary.LittleEndian.Uint16(m.recv_tx.Opcode[:]) {
+	case OP_TX:
+		return nil
+	case OP_NACK:
+		return ErrTxRejected
+	}
+	return m.expectOP(OP_TX)
+}
+
+// Ask the node for its identity
+func (m *SocketData) Identify(ctx context.Context) (_ NodeIdentity, err error) {
+	done, err := m.begin(ctx, OP_IDENTIFY, m.Timeouts.withDefaults().Op)
+	if err != nil {
+		return NodeIdentity{}, err
+	}
+	defer func() { err = done(err) }()
+
+	m.send_tx = NewTX(nil)
+	m.send_tx.ID1 = m.recv_tx.ID1
+	m.send_tx.ID2 = m.recv_tx.ID2
+
+	// Send OP_IDENTIFY
+	err = m.SendOP(OP_IDENTIFY)
+	if err != nil {
+		return NodeIdentity{}, err
+	}
+
+	err = m.recvTX()
+	if err != nil {
+		return NodeIdentity{}, err
+	}
+
+	// The reply is OP_IDENTIFY too
+	err = m.expectOP(OP_IDENTIFY)
+	if err != nil {
+		return NodeIdentity{}, err
+	}
+
+	// Read the fields from src_addr
+	text_len := int(binary.LittleEndian.Uint16(m.recv_tx.Len[:]))
+	if text_len > TXADDRLEN {
+		return NodeIdentity{}, &LengthError{Type: "identity", Expected: TXADDRLEN, Received: text_len}
+	}
+	identity := parseIdentity(string(m.recv_tx.Src_addr[:text_len]))
+	identity.Version = m.recv_tx.Version[0]
+	identity.Capabilities = Capabilities(m.recv_tx.Version[1])
+	identity.Updated = time.Now()
+	return identity, nil
+}
+
+// Get the hash of block block_num with OP_HASH.
+// A node without the block replies OP_NACK, reported as ErrBlockNotFound.
+func (m *SocketData) GetBlockHash(ctx context.Context, block_num uint64) (_ [HASHLEN]byte, err error) {
+	done, err := m.begin(ctx, OP_HASH, m.Timeouts.withDefaults().Op)
+	if err != nil {
+		return [HASHLEN]byte{}, err
+	}
+	defer func() { err = done(err) }()
+
+	m.send_tx = NewTX(nil)
+	m.send_tx.ID1 = m.recv_tx.ID1
+	m.send_tx.ID2 = m.recv_tx.ID2
+
+	// Set the block number
+	binary.LittleEndian.PutUint64(m.send_tx.Blocknum[:], block_num)
+
+	// Send OP_HASH
+	err = m.SendOP(OP_HASH)
+	if err != nil {
+		return [HASHLEN]byte{}, err
+	}
+
+	err = m.recvTX()
+	if err != nil {
+		return [HASHLEN]byte{}, err
+	}
+	if binary.LittleEndian.Uint16(m.recv_tx.Opcode[:]) == OP_NACK {
+		return [HASHLEN]byte{}, fmt.Errorf("%w: block %d", ErrBlockNotFound, block_num)
+	}
+	err = m.expectOP(OP_HASH)
+	if err != nil {
+		return [HASHLEN]byte{}, err
+	}
+
+	// The hash is in cblockhash
+	return m.recv_tx.Cblockhash, nil
+}
+
 // Get block from block number
-func (m *SocketData) GetBlockBytes(block_num uint64) ([]byte, error) {
+func (m *SocketData) GetBlockBytes(ctx context.Context, block_num uint64) ([]byte, error) {
+	var file bytes.Buffer
+	_, err := m.GetBlockTo(ctx, block_num, &file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return file.Bytes(), nil
+}
+
+// Stream block from block number into w, up to MAXBLOCKSIZE bytes.
+// progress, if not nil, is called after every received frame.
+// The download is bound by the Transfer timeout, and fails if no frame
+// arrives within the Idle timeout.
+func (m *SocketData) GetBlockTo(ctx context.Context, block_num uint64, w io.Writer, progress ProgressFunc) (_ int64, err error) {
+	done, err := m.begin(ctx, OP_GET_BLOCK, m.Timeouts.Transfer)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = done(err) }()
+	m.extendDeadline(ctx)
+
 	m.send_tx = NewTX(nil)
 	m.send_tx.ID1 = m.recv_tx.ID1
 	m.send_tx.ID2 = m.recv_tx.ID2
@@ -117,16 +282,112 @@ func (m *SocketData) GetBlockBytes(block_num uint64) ([]byte, error) {
 	binary.LittleEndian.PutUint64(m.send_tx.Blocknum[:], block_num)
 
 	// Send OP_GET_BLOCK
-	err := m.SendOP(OP_GET_BLOCK)
+	err = m.SendOP(OP_GET_BLOCK)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.recvFileTo(ctx, w, MAXBLOCKSIZE, progress)
+}
+
+// Get the trailer file of the node, the trailers of the whole chain
+func (m *SocketData) GetTrailerFile(ctx context.Context) ([]BTRAILER, error) {
+	var file bytes.Buffer
+	_, err := m.GetTrailerFileTo(ctx, &file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return TrailersFromBytes(file.Bytes())
+}
+
+// Stream the trailer file of the node into w, up to MAXTFILESIZE bytes.
+// Timeouts and progress work as in GetBlockTo.
+func (m *SocketData) GetTrailerFileTo(ctx context.Context, w io.Writer, progress ProgressFunc) (_ int64, err error) {
+	done, err := m.begin(ctx, OP_GET_TFILE, m.Timeouts.Transfer)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { err = done(err) }()
+	m.extendDeadline(ctx)
+
+	m.send_tx = NewTX(nil)
+	m.send_tx.ID1 = m.recv_tx.ID1
+	m.send_tx.ID2 = m.recv_tx.ID2
+
+	// Send OP_GET_TFILE
+	err = m.SendOP(OP_GET_TFILE)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.recvFileTo(ctx, w, MAXTFILESIZE, progress)
+}
+
+// Get up to count trailers from block start with OP_TF, fewer if the chain
+// of the node ends before. The trailers are checked to be the requested
+// blocks, each linked to the previous one.
+func (m *SocketData) GetTrailers(ctx context.Context, start uint64, count uint32) (_ []BTRAILER, err error) {
+	if count > MAXTFCOUNT {
+		return nil, &LengthError{Type: "OP_TF count", Expected: MAXTFCOUNT, Received: int(count)}
+	}
+	if start > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: block %d does not fit OP_TF", ErrTrailerRange, start)
+	}
+	done, err := m.begin(ctx, OP_TF, m.Timeouts.Transfer)
 	if err != nil {
 		return nil, err
 	}
+	defer func() { err = done(err) }()
+	m.extendDeadline(ctx)
 
-	file, err := m.recvFile()
+	m.send_tx = NewTX(nil)
+	m.send_tx.ID1 = m.recv_tx.ID1
+	m.send_tx.ID2 = m.recv_tx.ID2
+
+	// The first block number and the count share blocknum
+	binary.LittleEndian.PutUint32(m.send_tx.Blocknum[:4], uint32(start))
+	binary.LittleEndian.PutUint32(m.send_tx.Blocknum[4:], count)
+
+	// Send OP_TF
+	err = m.SendOP(OP_TF)
+	if err != nil {
+		return nil, err
+	}
+
+	var file bytes.Buffer
+	_, err = m.recvFileTo(ctx, &file, int64(count)*BTRAILER_LEN, nil)
+	if err != nil {
+		return nil, err
+	}
+	trailers, err := TrailersFromBytes(file.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	err = checkTrailers(nil, start, trailers)
+	if err != nil {
+		return nil, err
+	}
+	return trailers, nil
+}
+
+// Get the trailers that follow last, up to the block number announced by
+// the node in the handshake and at most MAXTFCOUNT of them: call it again,
+// on a new connection, with the last trailer returned to go on.
+// The first trailer must link to last, else ErrBrokenChain is returned:
+// the node is on another chain from last on.
+func (m *SocketData) CatchUpTrailers(ctx context.Context, last BTRAILER) ([]BTRAILER, error) {
+	start := last.BlockNum() + 1
+	if m.block_num < start {
+		return nil, nil
+	}
+	count := min(m.block_num-start+1, MAXTFCOUNT)
+	trailers, err := m.GetTrailers(ctx, start, uint32(count))
+	if err != nil {
+		return nil, err
+	}
+	err = checkTrailers(&last, start, trailers)
 	if err != nil {
 		return nil, err
 	}
-	//print file length
-	fmt.Println("File length:", len(file))
-	return file, nil
+	return trailers, nil
 }
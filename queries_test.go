@@ -0,0 +1,151 @@
+package mcminterface
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// Build a chain of n trailers from block 0, each linked to the previous one
+func testChain(n int) []BTRAILER {
+	trailers := make([]BTRAILER, n)
+	for i := range trailers {
+		if i > 0 {
+			trailers[i].Phash = trailers[i-1].Bhash
+		}
+		binary.LittleEndian.PutUint64(trailers[i].Bnum[:], uint64(i))
+		binary.LittleEndian.PutUint32(trailers[i].Stime[:], uint32(1700000000+i*337))
+		rand.Read(trailers[i].Bhash[:])
+	}
+	return trailers
+}
+
+func TestGetTrailerFile(t *testing.T) {
+	// 200 trailers span several OP_SEND_FILE frames
+	chain := testChain(200)
+	_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetTrailers(chain)
+	})
+	ctx := context.Background()
+
+	sd, err := ConnectToNode(ctx, addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	trailers, err := sd.GetTrailerFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trailers) != len(chain) {
+		t.Fatalf("%d trailers, want %d", len(trailers), len(chain))
+	}
+	for i := range trailers {
+		if trailers[i] != chain[i] {
+			t.Fatalf("trailer %d differs", i)
+		}
+	}
+}
+
+func TestGetTrailers(t *testing.T) {
+	chain := testChain(100)
+	_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetTrailers(chain)
+	})
+	ctx := context.Background()
+
+	// A range in the middle of the chain
+	sd, err := ConnectToNode(ctx, addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	trailers, err := sd.GetTrailers(ctx, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trailers) != 5 || trailers[0] != chain[10] || trailers[4] != chain[14] {
+		t.Errorf("got %d trailers, want blocks 10 to 14", len(trailers))
+	}
+}
+
+func TestCatchUpTrailers(t *testing.T) {
+	chain := testChain(2500)
+	// Same height, but the chain forks at block 1200
+	fork := append([]BTRAILER(nil), chain...)
+	rand.Read(fork[1200].Phash[:])
+	_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetTrailers(chain)
+		node.SetBlockNum(chain[len(chain)-1].BlockNum())
+	})
+	_, forked := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetTrailers(fork)
+		node.SetBlockNum(fork[len(fork)-1].BlockNum())
+	})
+	ctx := context.Background()
+
+	// Catch up from block 1199, one connection per request
+	held := append([]BTRAILER(nil), chain[:1200]...)
+	requests := 0
+	for {
+		sd, err := ConnectToNode(ctx, addrs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		trailers, err := sd.CatchUpTrailers(ctx, held[len(held)-1])
+		sd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trailers) == 0 {
+			break
+		}
+		held = append(held, trailers...)
+		requests++
+	}
+	if len(held) != len(chain) || held[len(held)-1] != chain[len(chain)-1] || requests != 2 {
+		t.Errorf("holding %d trailers after %d requests, want %d after 2", len(held), requests, len(chain))
+	}
+
+	// The forked node does not link to our block 1199
+	sd, err := ConnectToNode(ctx, forked[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	if _, err := sd.CatchUpTrailers(ctx, chain[1199]); !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("got %v, want ErrBrokenChain", err)
+	}
+}
+
+func TestGetBlockHash(t *testing.T) {
+	chain := testChain(100)
+	_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetTrailers(chain)
+	})
+	ctx := context.Background()
+
+	sd, err := ConnectToNode(ctx, addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := sd.GetBlockHash(ctx, 50)
+	sd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != chain[50].Bhash {
+		t.Errorf("hash %x, want %x", hash, chain[50].Bhash)
+	}
+
+	sd, err = ConnectToNode(ctx, addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	if _, err := sd.GetBlockHash(ctx, 1000); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("missing block: got %v, want ErrBlockNotFound", err)
+	}
+}
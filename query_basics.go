@@ -1,14 +1,20 @@
-package main
+// Package mcminterface is a library for interfacing with the MCM Network
+// through the native socket/tcp protocol.
+package mcminterface
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
-
-	"github.com/sigurn/crc16"
 )
 
 // Settings
@@ -20,10 +26,11 @@ const (
 
 // Define constants
 const (
-	PVERSION  = 4      /* protocol version number (short) */
-	CWALLET   = 2      /* indicate that we are a wallet */
-	TXNETWORK = 0x3905 /* network number for transactions */
-	TXTRAILER = 0xcdab /* trailer for transactions comms */
+	PVERSION     = 4      /* protocol version number (short) */
+	MIN_PVERSION = 4      /* oldest protocol version we downgrade to */
+	CWALLET      = 2      /* indicate that we are a wallet */
+	TXNETWORK    = 0x3905 /* network number for transactions */
+	TXTRAILER    = 0xcdab /* trailer for transactions comms */
 
 	OP_NULL       = 0  /* null operation code */
 	OP_HELLO      = 1  /* hello first step in handshake */
@@ -48,6 +55,10 @@ const (
 	OP_IDENTIFY   = 19 /* identify opcode */
 	LAST_OP       = 19 /* last valid opcode */
 
+	MAXBLOCKSIZE = 83886080  /* maximum size of a block file in bytes */
+	MAXTFILESIZE = 268435456 /* maximum size of a trailer file in bytes */
+	MAXTFCOUNT   = 1000      /* maximum trailers asked by a single OP_TF request */
+
 	TXADDRLEN = 2208
 	TXTAGLEN  = 12
 	TXAMOUNT  = 8
@@ -81,6 +92,7 @@ type TX struct {
 // initialize the TX struct
 func (m *TX) Init() {
 	m.Version[0] = byte(PVERSION)
+	m.Version[1] = byte(CWALLET)
 	m.Network[0] = byte(TXNETWORK >> 8)
 	m.Network[1] = byte(TXNETWORK & 0xff)
 	m.Trailer[0] = byte(TXTRAILER >> 8)
@@ -91,53 +103,13 @@ func (m *TX) Init() {
 }
 
 // Deserialize the TX struct
-func (m *TX) Deserialize(bytes []byte) {
-	// Deserialize the TX struct
-	copy(m.Version[:], bytes[0:2])
-	copy(m.Network[:], bytes[2:4])
-	copy(m.ID1[:], bytes[4:6])
-	copy(m.ID2[:], bytes[6:8])
-	copy(m.Opcode[:], bytes[8:10])
-	copy(m.Cblock[:], bytes[10:18])
-	copy(m.Blocknum[:], bytes[18:26])
-	copy(m.Cblockhash[:], bytes[26:58])
-	copy(m.Pblockhash[:], bytes[58:90])
-	copy(m.Weight[:], bytes[90:122])
-	copy(m.Len[:], bytes[122:124])
-	copy(m.Src_addr[:], bytes[124:2332])
-	copy(m.Dst_addr[:], bytes[2332:4540])
-	copy(m.Chg_addr[:], bytes[4540:6748])
-	copy(m.Send_total[:], bytes[6748:6756])
-	copy(m.Change_total[:], bytes[6756:6764])
-	copy(m.Tx_fee[:], bytes[6764:6772])
-	copy(m.Tx_sig[:], bytes[6772:8918])
-	copy(m.Crc16[:], bytes[8916:8918])
-	copy(m.Trailer[:], bytes[8918:8920])
+func (m *TX) Deserialize(bytes []byte) error {
+	return m.UnmarshalBinary(bytes)
 }
 
 // Serialize the TX struct
 func (m *TX) serialize() []byte {
-	var buf []byte
-	buf = append(buf, m.Version[:]...)
-	buf = append(buf, m.Network[:]...)
-	buf = append(buf, m.ID1[:]...)
-	buf = append(buf, m.ID2[:]...)
-	buf = append(buf, m.Opcode[:]...)
-	buf = append(buf, m.Cblock[:]...)
-	buf = append(buf, m.Blocknum[:]...)
-	buf = append(buf, m.Cblockhash[:]...)
-	buf = append(buf, m.Pblockhash[:]...)
-	buf = append(buf, m.Weight[:]...)
-	buf = append(buf, m.Len[:]...)
-	buf = append(buf, m.Src_addr[:]...)
-	buf = append(buf, m.Dst_addr[:]...)
-	buf = append(buf, m.Chg_addr[:]...)
-	buf = append(buf, m.Send_total[:]...)
-	buf = append(buf, m.Change_total[:]...)
-	buf = append(buf, m.Tx_fee[:]...)
-	buf = append(buf, m.Tx_sig[:]...)
-	buf = append(buf, m.Crc16[:]...)
-	buf = append(buf, m.Trailer[:]...)
+	buf, _ := m.MarshalBinary()
 	return buf
 }
 
@@ -148,11 +120,15 @@ func (m *TX) GetBytes() []byte {
 	return m.serialize()
 }
 
+// Create a TX struct from a frame, or a new one to send if bytes is nil.
+// An invalid frame gives an empty TX: use UnmarshalBinary to get the error.
 func NewTX(bytes []byte) TX {
 	var tx TX
 	if bytes != nil {
 		// Deserialize the TX struct
-		tx.Deserialize(bytes)
+		if tx.Deserialize(bytes) != nil {
+			return TX{}
+		}
 	} else {
 		// Create a new TX struct
 		tx.Init()
@@ -162,12 +138,10 @@ func NewTX(bytes []byte) TX {
 
 // Compute the CRC16 checksum up to signature
 func (m *TX) computeCRC16() {
-	buf := m.serialize()[:8916]
-	//fmt.Printf("buf: %x\n", buf)
-	table := crc16.MakeTable(crc16.CRC16_XMODEM)
-	rcrc16 := crc16.Checksum(buf, table)
-	m.Crc16[0] = byte(rcrc16 & 0xff)
-	m.Crc16[1] = byte(rcrc16 >> 8)
+	frame := frame_pool.Get().(*[TX_LEN]byte)
+	defer frame_pool.Put(frame)
+	buf, _ := m.AppendBinary(frame[:0])
+	binary.LittleEndian.PutUint16(m.Crc16[:], frameCRC16(buf))
 }
 
 // Get the version of the MCM interface
@@ -175,129 +149,419 @@ func (m *TX) GetVersion() int {
 	return int(m.Version[0])
 }
 
+// Timeouts of the socket operations, zero values take the defaults
+type Timeouts struct {
+	Dial      time.Duration // connecting to the node
+	Handshake time.Duration // OP_HELLO until OP_HELLO_ACK
+	Op        time.Duration // single request and reply operations such as GetBalance
+	Transfer  time.Duration // whole file download, zero for no limit
+	Idle      time.Duration // wait for the next frame of a file download
+}
+
+// Default timeouts of a SocketData
+var DefaultTimeouts = Timeouts{
+	Dial:      SOCK_WRITE_TIMEOUT * time.Second,
+	Handshake: SOCK_READ_TIMEOUT * time.Second,
+	Op:        SOCK_READ_TIMEOUT * time.Second,
+	Transfer:  0,
+	Idle:      SOCK_READ_TIMEOUT * time.Second,
+}
+
+// Fill the zero timeouts with the defaults, Transfer stays unlimited
+func (t Timeouts) withDefaults() Timeouts {
+	if t.Dial <= 0 {
+		t.Dial = DefaultTimeouts.Dial
+	}
+	if t.Handshake <= 0 {
+		t.Handshake = DefaultTimeouts.Handshake
+	}
+	if t.Op <= 0 {
+		t.Op = DefaultTimeouts.Op
+	}
+	if t.Idle <= 0 {
+		t.Idle = DefaultTimeouts.Idle
+	}
+	return t
+}
+
 type SocketData struct {
-	IP        string
+	IP        string // IP or host name, with an optional port
+	Address   string // address dialed by Connect, host names resolved
 	Conn      net.Conn
+	Timeouts  Timeouts     // zero values take DefaultTimeouts
+	Dialer    Dialer       // nil for a net.Dialer
+	Logger    *slog.Logger // nil for no logging
+	Metrics   *Metrics     // nil for no metrics
 	send_tx   TX
 	recv_tx   TX
 	block_num uint64
+	session   bool          // handshake completed, ID2 is known
+	peer      PeerVersion   // announced by the node in OP_HELLO_ACK
+	tip       NodeTip       // announced by the node in OP_HELLO_ACK
+	deadline  time.Time     // deadline of the current operation, zero for none
+	extended  time.Time     // last time the idle deadline was moved
+	release   func()        // frees the connection slot of a Client on Close
+	frame     *[TX_LEN]byte // pooled buffer of the last received frame
+}
+
+// PeerVersion is the protocol version and the capabilities announced by a
+// node in the handshake, and the protocol version used for the session
+type PeerVersion struct {
+	Version      uint8        // protocol version of the node
+	Capabilities Capabilities // capability bits of the node
+	Session      uint8        // protocol version of our frames
+}
+
+// Get the current block number reported by the node
+func (m *SocketData) GetBlockNum() uint64 {
+	return m.block_num
+}
+
+// Get the chain tip announced by the node, valid after Hello
+func (m *SocketData) Tip() NodeTip {
+	return m.tip
+}
+
+// Get the version and capabilities of the node, valid after Hello
+func (m *SocketData) Peer() PeerVersion {
+	return m.peer
+}
+
+// Agree on the protocol version with a node announcing version.
+// We speak PVERSION to newer nodes, which are expected to keep speaking
+// to older peers, and downgrade down to MIN_PVERSION for older nodes.
+func negotiateVersion(version uint8) (uint8, error) {
+	switch {
+	case version >= PVERSION:
+		return PVERSION, nil
+	case version >= MIN_PVERSION:
+		return version, nil
+	}
+	return 0, &FrameError{Field: "Version", Expected: MIN_PVERSION, Received: uint16(version), Err: ErrWrongVersion}
 }
 
 // Send OP to IP
 func (m *SocketData) SendOP(op uint16) error {
 	// Set the opcode
 	m.send_tx.Opcode = [2]byte{byte(op & 0xff), byte(op >> 8)}
-	m.send_tx.computeCRC16()
-	//fmt.Println("Sending OP:", op)
-	// Send the TX struct
+	// Send the TX struct, the crc16 is computed while encoding
 	return m.sendTX()
 }
 
-// Connect to IP : 2095
-func (m *SocketData) Connect() {
-	// Connect to the IP
-	// print
-	address := fmt.Sprintf("%s:%d", m.IP, DEFAULT_PORT)
-	fmt.Println("Connecting to:", address)
-	conn, err := net.Dial("tcp", address)
+// Split a node entry into host and port, the port defaults to DEFAULT_PORT
+func splitNode(node string) (string, string) {
+	host, port, err := net.SplitHostPort(node)
 	if err != nil {
-		fmt.Println("Error connecting:", err)
-		return
+		return strings.Trim(node, "[]"), strconv.Itoa(DEFAULT_PORT)
+	}
+	return host, port
+}
+
+// Normalize a node entry, an IP or host name with an optional port:
+// the host alone on DEFAULT_PORT, host:port otherwise
+func NormalizeNode(node string) string {
+	host, port := splitNode(node)
+	if port == strconv.Itoa(DEFAULT_PORT) {
+		return host
 	}
-	fmt.Println("Connected to:", address)
-	m.Conn = conn
-	m.Conn.SetWriteDeadline(time.Now().Add(SOCK_WRITE_TIMEOUT * time.Second))
-	m.Conn.SetReadDeadline(time.Now().Add(SOCK_READ_TIMEOUT * time.Second))
+	return net.JoinHostPort(host, port)
+}
+
+// Connect to IP, an IP or host name with an optional port (2095 by default).
+// Host names are resolved here, unless the dialer is a HostnameResolver
+// such as SOCKS5Dialer, and every resolved address is tried in turn.
+func (m *SocketData) Connect(ctx context.Context) error {
+	dialer := m.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	dial_ctx, cancel := context.WithTimeout(ctx, m.Timeouts.withDefaults().Dial)
+	defer cancel()
+
+	host, port := splitNode(m.IP)
+	addresses := []string{net.JoinHostPort(host, port)}
+	resolver, ok := dialer.(HostnameResolver)
+	if !(ok && resolver.ResolvesHostnames()) && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIPAddr(dial_ctx, host)
+		if err != nil {
+			return err
+		}
+		addresses = addresses[:0]
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	err := fmt.Errorf("no address found for %s", host)
+	for _, address := range addresses {
+		start := time.Now()
+		m.logger().Debug("connecting", "node", m.IP, "address", address)
+		var conn net.Conn
+		conn, err = dialer.DialContext(dial_ctx, "tcp", address)
+		if err == nil {
+			m.logger().Debug("connected", "node", m.IP, "address", address, "duration", time.Since(start))
+			m.Conn = conn
+			m.Address = address
+			return nil
+		}
+		m.logger().Debug("connection failed", "node", m.IP, "address", address, "duration", time.Since(start), "err", err)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w: %w", ErrConnectionRefused, err)
+	}
+	return err
+}
+
+// Close the connection
+func (m *SocketData) Close() error {
+	if m.release != nil {
+		m.release()
+		m.release = nil
+	}
+	if m.Conn == nil {
+		return nil
+	}
+	err := m.Conn.Close()
+	m.Conn = nil
+	m.session = false
+	if m.frame != nil {
+		frame_pool.Put(m.frame)
+		m.frame = nil
+	}
+	return err
+}
+
+// Map ctx and timeout onto the socket deadlines for the duration of an
+// operation, a zero timeout only keeps the ctx deadline.
+// The returned function must be called with the operation result once
+// the operation is over: it returns ctx.Err() if ctx ended the operation,
+// and records the operation in the metrics under the request opcode op.
+func (m *SocketData) begin(ctx context.Context, op uint16, timeout time.Duration) (func(error) error, error) {
+	// Check if connection is active
+	if m.Conn == nil {
+		return nil, ErrNotConnected
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn := m.Conn
+	m.deadline = time.Time{}
+	if timeout > 0 {
+		m.deadline = time.Now().Add(timeout)
+	}
+	if deadline, ok := ctx.Deadline(); ok && (m.deadline.IsZero() || deadline.Before(m.deadline)) {
+		m.deadline = deadline
+	}
+	m.extended = time.Time{}
+	conn.SetDeadline(m.deadline)
+
+	// Unblock pending reads and writes when ctx is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	start := time.Now()
+	return func(err error) error {
+		stop()
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		m.Metrics.observeOp(m.IP, op, time.Since(start), err)
+		return err
+	}, nil
 }
 
 // Send TX struct to IP
 func (m *SocketData) sendTX() error {
 	// Check if connection is active
 	if m.Conn == nil {
-		return fmt.Errorf("connection is nil")
+		return ErrNotConnected
+	}
+	frame := frame_pool.Get().(*[TX_LEN]byte)
+	defer frame_pool.Put(frame)
+
+	// Speak the protocol version agreed in the handshake
+	if m.session {
+		m.send_tx.Version[0] = m.peer.Session
 	}
-	bytes := m.send_tx.GetBytes()
-	_, err := m.Conn.Write(bytes)
+	// Encode once and compute the crc16 over the wire bytes
+	buf, _ := m.send_tx.AppendBinary(frame[:0])
+	binary.LittleEndian.PutUint16(m.send_tx.Crc16[:], frameCRC16(buf))
+	copy(buf[TX_CRC_LEN:], m.send_tx.Crc16[:])
+	_, err := m.Conn.Write(buf)
 	if err != nil {
-		fmt.Println("Error writing:", err)
+		m.logFrame("send failed", &m.send_tx, err)
 		return err
 	}
+	m.logFrame("sent", &m.send_tx, nil)
 	return nil
 }
 
 // Receive TX struct from IP
-func (m *SocketData) recvTX() error {
-	buf := make([]byte, 8920)
+func (m *SocketData) recvTX() (err error) {
+	// Check if connection is active
+	if m.Conn == nil {
+		return ErrNotConnected
+	}
+	defer func() {
+		if err != nil {
+			m.Metrics.observeFrameError(m.IP, err)
+		}
+	}()
+	// Read into the pooled frame buffer, kept until Close
+	if m.frame == nil {
+		m.frame = frame_pool.Get().(*[TX_LEN]byte)
+	}
+	buf := m.frame[:]
 	// read full
 	n, err := io.ReadFull(m.Conn, buf)
 	if err != nil {
-		if err == io.EOF && n != 0 {
-			fmt.Println("Connection closed before reading all bytes")
-		} else if n != 0 {
-			fmt.Println("Error reading:", err)
+		// io.EOF is kept as is: the node closed the connection between frames
+		if n != 0 {
+			return &ShortReadError{Expected: len(buf), Received: n, Err: err}
 		}
 		return err
 	}
-	// If received less than 8920 bytes, return
-	if n < 8920 {
-		return fmt.Errorf("received less than 8920 bytes")
+
+	// Check the crc16 over the wire bytes
+	rcrc16 := frameCRC16(buf)
+	if crc := binary.LittleEndian.Uint16(buf[TX_CRC_LEN:]); rcrc16 != crc {
+		return &CRCError{Expected: rcrc16, Actual: crc}
 	}
+
 	// Deserialize the TX struct
-	m.recv_tx = NewTX(buf)
-	// print received OPCODE
-	//fmt.Println("Received OPCODE:", m.recv_tx.Opcode[0])
-
-	table := crc16.MakeTable(crc16.CRC16_XMODEM)
-	rcrc16 := crc16.Checksum(m.recv_tx.GetBytes()[:8916], table)
-	// Check if rcrc16 is equal to crc16
-	if rcrc16 != binary.LittleEndian.Uint16(m.recv_tx.Crc16[:]) {
-		fmt.Printf("crc16: %x\n", m.recv_tx.Crc16)
-		fmt.Printf("rcrc16: %x\n", rcrc16)
-		// print ID1
-		fmt.Println("ID1:", m.recv_tx.ID1)
-		// print ID2
-		fmt.Println("ID2:", m.recv_tx.ID2)
-
-		// print the received tx
-		//fmt.Println("recv_tx:", m.recv_tx.GetBytes())
-		return fmt.Errorf("crc16 checksum failed")
+	err = m.recv_tx.UnmarshalBinary(buf)
+	if err != nil {
+		return err
 	}
 
 	// Check the trailer
-	if binary.BigEndian.Uint16(m.recv_tx.Trailer[:]) != TXTRAILER {
-		return fmt.Errorf("trailer failed")
+	if trailer := binary.BigEndian.Uint16(m.recv_tx.Trailer[:]); trailer != TXTRAILER {
+		return fmt.Errorf("%w: %04x", ErrBadTrailer, trailer)
+	}
+
+	// Check that the frame belongs to our network and session
+	err = m.validateTX(&m.recv_tx)
+	if err != nil {
+		m.logFrame("frame rejected", &m.recv_tx, err)
+		return err
 	}
+	m.logFrame("received", &m.recv_tx, nil)
 
 	// Get the block number
 	m.block_num = binary.LittleEndian.Uint64(m.recv_tx.Cblock[:])
 	return nil
 }
 
-// Receive file from IP
-func (m *SocketData) recvFile() ([]byte, error) {
-	var file []byte
+// Validate a received frame against the network and the session.
+// The version must be one we can negotiate, then the one announced by the
+// node or the one of the session.
+// ID1 must echo the one we sent, ID2 must match the handshake once done.
+func (m *SocketData) validateTX(tx *TX) error {
+	if _, err := negotiateVersion(tx.Version[0]); err != nil {
+		return err
+	}
+	if m.session && tx.Version[0] != m.peer.Version && tx.Version[0] != m.peer.Session {
+		return &FrameError{Field: "Version", Expected: uint16(m.peer.Version), Received: uint16(tx.Version[0]), Err: ErrWrongVersion}
+	}
+	if network := binary.BigEndian.Uint16(tx.Network[:]); network != TXNETWORK {
+		return &FrameError{Field: "Network", Expected: TXNETWORK, Received: network, Err: ErrWrongNetwork}
+	}
+	if tx.ID1 != m.send_tx.ID1 {
+		return &FrameError{
+			Field:    "ID1",
+			Expected: binary.LittleEndian.Uint16(m.send_tx.ID1[:]),
+			Received: binary.LittleEndian.Uint16(tx.ID1[:]),
+			Err:      ErrSessionMismatch,
+		}
+	}
+	if m.session && tx.ID2 != m.send_tx.ID2 {
+		return &FrameError{
+			Field:    "ID2",
+			Expected: binary.LittleEndian.Uint16(m.send_tx.ID2[:]),
+			Received: binary.LittleEndian.Uint16(tx.ID2[:]),
+			Err:      ErrSessionMismatch,
+		}
+	}
+	return nil
+}
+
+// Push the socket deadlines to the idle timeout from now, without going
+// past the deadline of the operation. Called whenever a transfer progresses.
+func (m *SocketData) extendDeadline(ctx context.Context) {
+	idle := m.Timeouts.withDefaults().Idle
+	now := time.Now()
+	// Frames arrive much faster than the idle timeout, moving the
+	// deadline at most every eighth of it keeps the syscalls down
+	if now.Sub(m.extended) < idle/8 {
+		return
+	}
+	m.extended = now
+	deadline := now.Add(idle)
+	if !m.deadline.IsZero() && m.deadline.Before(deadline) {
+		deadline = m.deadline
+	}
+	m.Conn.SetDeadline(deadline)
+	// ctx may have been cancelled while we moved the deadline
+	if ctx.Err() != nil {
+		m.Conn.SetDeadline(time.Unix(1, 0))
+	}
+}
+
+// ProgressFunc is called after every OP_SEND_FILE frame with the bytes received so far
+type ProgressFunc func(received int64)
+
+// Receive file from IP into w, failing once more than limit bytes arrive.
+// The idle deadline is extended on every frame.
+func (m *SocketData) recvFileTo(ctx context.Context, w io.Writer, limit int64, progress ProgressFunc) (int64, error) {
+	var received int64
+	start := time.Now()
 
 	// Until the connection is closed, keep receiving TX structs
 	for {
+		m.extendDeadline(ctx)
 		err := m.recvTX()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, err
+			return received, err
 		}
 		// Check if opcode is OP_SEND_FILE
-		if m.recv_tx.Opcode[0] != byte(OP_SEND_FILE) {
-			return nil, fmt.Errorf("opcode is not OP_SEND_FILE")
+		err = m.expectOP(OP_SEND_FILE)
+		if err != nil {
+			return received, err
 		}
 
 		// Bytes received in len
-		len := binary.LittleEndian.Uint16(m.recv_tx.Len[:])
+		len := int(binary.LittleEndian.Uint16(m.recv_tx.Len[:]))
+		if len > TX_BUFFER_LEN {
+			return received, &LengthError{Type: "OP_SEND_FILE payload", Expected: TX_BUFFER_LEN, Received: len}
+		}
+		if received+int64(len) > limit {
+			return received, fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, limit)
+		}
 
-		// Get the bytes
-		file = append(file, m.recv_tx.GetBytes()[124:124+len]...)
+		// Write the bytes straight from the frame buffer
+		n, err := w.Write(m.frame[TX_BUFFER_OFF : TX_BUFFER_OFF+len])
+		received += int64(n)
+		if err != nil {
+			return received, err
+		}
+		if progress != nil {
+			progress(received)
+		}
 	}
-	return file, nil
+	m.logger().Debug("file received", "node", m.IP, "bytes", received, "duration", time.Since(start))
+	return received, nil
+}
+
+// Check that the received opcode is op
+func (m *SocketData) expectOP(op uint16) error {
+	received := binary.LittleEndian.Uint16(m.recv_tx.Opcode[:])
+	if received != op {
+		return &OpcodeError{Expected: op, Received: received}
+	}
+	return nil
 }
 
 // Copy ID2 from recv_tx to send_tx
@@ -306,70 +570,63 @@ func (m *SocketData) copyID2() {
 	m.send_tx.ID2 = m.recv_tx.ID2
 }
 
-// Connnect and send OP_HELLO and wait for OP_HELLO_ACK
-func (m *SocketData) Hello() error {
+// Connnect and send OP_HELLO and wait for OP_HELLO_ACK.
+// If Conn is already set the handshake runs on it.
+func (m *SocketData) Hello(ctx context.Context) (err error) {
 	// Connect to the IP
-	m.Connect()
+	if m.Conn == nil {
+		err = m.Connect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	done, err := m.begin(ctx, OP_HELLO, m.Timeouts.withDefaults().Handshake)
+	if err != nil {
+		return err
+	}
+	defer func() { err = done(err) }()
+
+	// Start a new session with a fresh ID1
+	m.send_tx = NewTX(nil)
+	m.session = false
+	m.peer = PeerVersion{}
+	m.tip = NodeTip{}
 	// Send OP_HELLO
-	err := m.SendOP(OP_HELLO)
+	err = m.SendOP(OP_HELLO)
 	if err != nil {
 		return err
 	}
-	//fmt.Println("Sent OP_HELLO")
 	// Receive TX struct
 	err = m.recvTX()
-	//fmt.Println("Received TX struct")
 	if err != nil {
 		return err
 	}
 	// Check if opcode is OP_HELLO_ACK
-	if m.recv_tx.Opcode[0] != byte(OP_HELLO_ACK) {
-		return fmt.Errorf("opcode is not OP_HELLO_ACK")
+	err = m.expectOP(OP_HELLO_ACK)
+	if err != nil {
+		return err
 	}
+	// Agree on the protocol version, validateTX refused the ones we cannot speak
+	m.peer.Version = m.recv_tx.Version[0]
+	m.peer.Capabilities = Capabilities(m.recv_tx.Version[1])
+	m.peer.Session, _ = negotiateVersion(m.peer.Version)
+	m.tip.get(&m.recv_tx)
+	m.logger().Debug("handshake", "node", m.IP, "version", m.peer.Version, "session", m.peer.Session,
+		"capabilities", m.peer.Capabilities.String())
 	// Copy ID2 from recv_tx to send_tx
 	m.copyID2()
+	m.session = true
 	return nil
 }
 
-func ConnectToNode(ip string) SocketData {
-	var sd SocketData
-	sd.IP = ip
-	sd.send_tx = NewTX(nil)
-	err := sd.Hello()
+// Connect to a node and complete the handshake.
+// The caller must Close the returned SocketData.
+func ConnectToNode(ctx context.Context, ip string) (*SocketData, error) {
+	sd := &SocketData{IP: ip}
+	err := sd.Hello(ctx)
 	if err != nil {
-		fmt.Println("Error:", err)
-	}
-	return sd
-}
-
-// main function
-func main() {
-	// Connect to node 35.212.41.137 195.181.241.89 192.168.1.70
-	//sd := ConnectToNode("192.168.1.70")
-	//test_dl_block()
-	//test_resolve_balance()
-	Settings = LoadSettings()
-	test_query_balance()
-	SaveSettings(Settings)
-	/*
-		Settings = LoadSettings()
-		ExpandIPs()
-		// print IPs
-		fmt.Println("IPs:", Settings.IPs)
-		BenchmarkNodes(10)
-
-		nodes := PickNodes(5)
-		// for each node print ip
-		for _, node := range nodes {
-			fmt.Print(node.IP, ":", node.Ping, " ")
-		}
-		fmt.Println("")
-		nodes = PickNodes(5)
-		// for each node print ip
-		for _, node := range nodes {
-			fmt.Print(node.IP, ":", node.Ping, " ")
-		}
-
-		SaveSettings(Settings)*/
-
+		sd.Close()
+		return nil, err
+	}
+	return sd, nil
 }
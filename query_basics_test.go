@@ -0,0 +1,338 @@
+package mcminterface
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Connect a SocketData to a peer running serve on the other end of a pipe.
+// Both ends are closed when the test ends.
+func pipeNode(t *testing.T, timeouts Timeouts, serve func(conn net.Conn)) *SocketData {
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		serve(server)
+	}()
+	sd := &SocketData{IP: "pipe", Conn: client, Timeouts: timeouts}
+	t.Cleanup(func() { sd.Close(); server.Close() })
+	return sd
+}
+
+// Answer the handshake on conn like a node, returning the reply sent.
+// edit, if not nil, alters the reply before it is sent.
+func pipeHandshake(conn net.Conn, edit func(reply *TX)) (TX, error) {
+	var hello TX
+	if err := mockRecv(conn, &hello); err != nil {
+		return TX{}, err
+	}
+	reply := NewTX(nil)
+	reply.ID1 = hello.ID1
+	rand.Read(reply.ID2[:])
+	if edit != nil {
+		edit(&reply)
+	}
+	return reply, mockSend(conn, &reply, OP_HELLO_ACK)
+}
+
+func TestValidateTX(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		serve  func(conn net.Conn)
+		reason string
+		want   error
+	}{
+		{"wrong network", func(conn net.Conn) {
+			pipeHandshake(conn, func(reply *TX) {
+				binary.BigEndian.PutUint16(reply.Network[:], TXNETWORK+1)
+			})
+		}, "network", ErrWrongNetwork},
+		{"wrong ID1", func(conn net.Conn) {
+			pipeHandshake(conn, func(reply *TX) { reply.ID1[0]++ })
+		}, "id1", ErrSessionMismatch},
+		{"ID2 changed after the handshake", func(conn net.Conn) {
+			session, err := pipeHandshake(conn, nil)
+			if err != nil {
+				return
+			}
+			var request TX
+			if mockRecv(conn, &request) != nil {
+				return
+			}
+			reply := session
+			reply.ID2[0]++
+			mockSend(conn, &reply, OP_SEND_BAL)
+		}, "id2", ErrSessionMismatch},
+	}
+	for _, test := range tests {
+		metrics := NewMetrics()
+		sd := pipeNode(t, Timeouts{}, test.serve)
+		sd.Metrics = metrics
+		err := sd.Hello(ctx)
+		if err == nil {
+			_, err = sd.GetBalance(ctx, WotsAddress{})
+		}
+		var frame_err *FrameError
+		if !errors.Is(err, test.want) || !errors.As(err, &frame_err) {
+			t.Errorf("%s: got %v, want a FrameError matching %v", test.name, err, test.want)
+			continue
+		}
+		if reasons := frameErrorReasons(metrics); len(reasons) != 1 || reasons[0] != test.reason {
+			t.Errorf("%s: frame errors counted with reasons %v, want [%s]", test.name, reasons, test.reason)
+		}
+	}
+}
+
+// The reason labels of the frame errors counted by metrics
+func frameErrorReasons(metrics *Metrics) []string {
+	var reasons []string
+	for _, family := range metrics.Collect() {
+		if family.Name != "mcm_frame_errors_total" {
+			continue
+		}
+		for _, sample := range family.Samples {
+			for _, label := range sample.Labels {
+				if label.Name == "reason" {
+					reasons = append(reasons, label.Value)
+				}
+			}
+		}
+	}
+	return reasons
+}
+
+func TestCancelPendingOperation(t *testing.T) {
+	// Timeouts far longer than the test, only the cancellation can end it
+	timeouts := Timeouts{Handshake: time.Minute, Op: time.Minute}
+	tests := []struct {
+		name  string
+		serve func(conn net.Conn)
+		run   func(ctx context.Context, sd *SocketData) error
+	}{
+		{"write of Hello", func(conn net.Conn) {
+			// never reads the request
+			time.Sleep(time.Minute)
+		}, func(ctx context.Context, sd *SocketData) error {
+			return sd.Hello(ctx)
+		}},
+		{"read of Hello", func(conn net.Conn) {
+			io.Copy(io.Discard, conn)
+		}, func(ctx context.Context, sd *SocketData) error {
+			return sd.Hello(ctx)
+		}},
+		{"read of GetBalance", func(conn net.Conn) {
+			if _, err := pipeHandshake(conn, nil); err == nil {
+				io.Copy(io.Discard, conn)
+			}
+		}, func(ctx context.Context, sd *SocketData) error {
+			if err := sd.Hello(context.Background()); err != nil {
+				return err
+			}
+			_, err := sd.GetBalance(ctx, WotsAddress{})
+			return err
+		}},
+	}
+	for _, test := range tests {
+		sd := pipeNode(t, timeouts, test.serve)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		done := make(chan error, 1)
+		go func() { done <- test.run(ctx, sd) }()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: got %v, want context.Canceled", test.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: not stopped by the cancellation", test.name)
+		}
+		cancel()
+	}
+}
+
+func TestNewTXVersion(t *testing.T) {
+	if tx := NewTX(nil); tx.Version[0] != PVERSION || tx.Version[1] != CWALLET {
+		t.Errorf("version bytes %v, want [%d %d]", tx.Version, PVERSION, CWALLET)
+	}
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	tests := []struct {
+		version uint8
+		session uint8 // 0 if the node must be refused
+	}{
+		{PVERSION, PVERSION},
+		{PVERSION + 1, PVERSION},
+		{MIN_PVERSION - 1, 0},
+	}
+	var address [TXADDRLEN]byte
+	ctx := context.Background()
+	for _, test := range tests {
+		_, addrs := startMockNodes(t, 1, func(node *MockNode) {
+			node.SetIdentity(NodeIdentity{Version: test.version, Capabilities: CapPush | CapSanctuary})
+			node.SetBalance(address, 42)
+		})
+		sd, err := ConnectToNode(ctx, addrs[0])
+		if test.session == 0 {
+			if !errors.Is(err, ErrWrongVersion) {
+				t.Errorf("version %d: got %v, want ErrWrongVersion", test.version, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("version %d: %v", test.version, err)
+			continue
+		}
+		peer := sd.Peer()
+		if peer.Version != test.version || peer.Session != test.session || peer.Capabilities != CapPush|CapSanctuary {
+			t.Errorf("version %d: peer %+v", test.version, peer)
+		}
+		balance, err := sd.GetBalance(ctx, WotsAddressFromBytes(address[:]))
+		if err != nil || balance != 42 {
+			t.Errorf("version %d: balance %d, %v", test.version, balance, err)
+		}
+		sd.Close()
+	}
+}
+
+// Serve a handshake on conn, then frames OP_SEND_FILE frames of payload
+func serveFile(conn net.Conn, frames int, payload []byte, every time.Duration) {
+	defer conn.Close()
+	var tx TX
+	if mockRecv(conn, &tx) != nil {
+		return
+	}
+	rand.Read(tx.ID2[:])
+	binary.LittleEndian.PutUint64(tx.Cblock[:], 1)
+	if mockSend(conn, &tx, OP_HELLO_ACK) != nil {
+		return
+	}
+	var request TX
+	if mockRecv(conn, &request) != nil {
+		return
+	}
+
+	// the same frame every time, encoded once
+	binary.LittleEndian.PutUint16(tx.Opcode[:], OP_SEND_FILE)
+	binary.LittleEndian.PutUint16(tx.Len[:], uint16(len(payload)))
+	copy(tx.Src_addr[:], payload)
+	tx.computeCRC16()
+	frame, _ := tx.MarshalBinary()
+	for i := 0; i < frames; i++ {
+		if i > 0 {
+			time.Sleep(every)
+		}
+		if _, err := conn.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+func TestGetBlockTo(t *testing.T) {
+	const frames = 5
+	payload := make([]byte, 1000)
+	rand.Read(payload)
+	ctx := context.Background()
+
+	sd := pipeNode(t, Timeouts{}, func(conn net.Conn) { serveFile(conn, frames, payload, 0) })
+	if err := sd.Hello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	var progress []int64
+	n, err := sd.GetBlockTo(ctx, 1, &file, func(received int64) {
+		progress = append(progress, received)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != frames*int64(len(payload)) || !bytes.Equal(file.Bytes(), bytes.Repeat(payload, frames)) {
+		t.Errorf("wrote %d bytes, want the %d bytes sent", file.Len(), frames*len(payload))
+	}
+	if len(progress) != frames || progress[len(progress)-1] != n {
+		t.Fatalf("progress %v, want %d calls ending at %d", progress, frames, n)
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Errorf("progress %v does not increase", progress)
+		}
+	}
+}
+
+func TestGetBlockToIdle(t *testing.T) {
+	payload := make([]byte, 100)
+	ctx := context.Background()
+	timeouts := Timeouts{Idle: 200 * time.Millisecond, Transfer: 5 * time.Second}
+
+	// Frames keep coming within the idle timeout for longer than it
+	sd := pipeNode(t, timeouts, func(conn net.Conn) { serveFile(conn, 8, payload, 60*time.Millisecond) })
+	if err := sd.Hello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := sd.GetBlockTo(ctx, 1, io.Discard, nil); err != nil {
+		t.Fatalf("slow transfer: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < timeouts.Idle {
+		t.Fatalf("transfer took %v, not longer than the idle timeout", elapsed)
+	}
+
+	// The second frame comes after the idle timeout
+	sd = pipeNode(t, timeouts, func(conn net.Conn) { serveFile(conn, 2, payload, time.Second) })
+	if err := sd.Hello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sd.GetBlockTo(ctx, 1, io.Discard, nil); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("stalled transfer: got %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestGetBlockToTooLarge(t *testing.T) {
+	payload := make([]byte, TX_BUFFER_LEN)
+	ctx := context.Background()
+
+	// One frame more than a block may take
+	sd := pipeNode(t, Timeouts{}, func(conn net.Conn) {
+		serveFile(conn, MAXBLOCKSIZE/TX_BUFFER_LEN+1, payload, 0)
+	})
+	if err := sd.Hello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	n, err := sd.GetBlockTo(ctx, 1, io.Discard, nil)
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("got %v, want ErrFileTooLarge", err)
+	}
+	if n > MAXBLOCKSIZE {
+		t.Errorf("%d bytes written past the limit of %d", n, MAXBLOCKSIZE)
+	}
+}
+
+func BenchmarkRecvFile(b *testing.B) {
+	const frames = 1000
+	payload := make([]byte, TX_BUFFER_LEN)
+	rand.Read(payload)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.SetBytes(frames * TX_BUFFER_LEN)
+	for i := 0; i < b.N; i++ {
+		client, server := net.Pipe()
+		go serveFile(server, frames, payload, 0)
+		sd := SocketData{IP: "pipe", Conn: client}
+		if err := sd.Hello(ctx); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := sd.GetBlockBytes(ctx, 1); err != nil {
+			b.Fatal(err)
+		}
+		sd.Close()
+	}
+}
@@ -1,17 +1,30 @@
-package main
+package mcminterface
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"math"
 	"math/rand/v2"
 	"os"
+	"sort"
+	"sync"
 	"time"
 )
 
-var Settings SettingsType
+// Default settings
+const (
+	DEFAULT_SETTINGS_PATH = "settings.json"
+	DEFAULT_QUERY_SIZE    = 5
+	DEFAULT_EXPAND_DEPTH  = 2
+)
 
-// Global settings
+// Settings of a Client, persisted to settings.json.
+// Node entries are IPs or host names, with a port when it is not DEFAULT_PORT
 type SettingsType struct {
 	StartIPs           []string
 	IPs                []string
@@ -19,19 +32,241 @@ type SettingsType struct {
 	IPExpandDepth      int
 	ForceQueryStartIPs bool // Forces to query only start ips bypassing PickNodes
 	QuerySize          int  // Number of nodes to query, quorum is 50% + 1
+	// Connection limits, 0 for the default and negative for no limit
+	NodeRateLimit  float64 // connections per second to a single node
+	NodeRateBurst  int     // connections to a single node allowed at once
+	MaxConnections int     // connections of the client open at the same time
 }
 
 type RemoteNode struct {
-	IP       string
+	IP       string // node entry: IP or host name with an optional port
+	Address  string `json:",omitempty"` // resolved ip:port of the last connection
 	LastSeen time.Time
 	Ping     uint32
+	Identity *NodeIdentity `json:",omitempty"` // last answer to OP_IDENTIFY, see IdentifyNodes
+}
+
+// Check if the node serves all of ops
+func (node RemoteNode) serves(ops []uint16) bool {
+	for _, op := range ops {
+		if !node.Identity.Supports(op) {
+			return false
+		}
+	}
+	return true
+}
+
+// Client owns a node table and runs queries against the MCM network.
+// All methods are safe for concurrent use.
+type Client struct {
+	mu            sync.RWMutex
+	settings      SettingsType
+	settings_path string
+	retry         RetryPolicy
+	on_outcome    func(NodeOutcome)
+	timeouts      Timeouts
+	query_timeout time.Duration // 0 to derive it from timeouts and retry
+	record_dir    string
+	dialer        Dialer
+	source_addrs  map[string]string // node -> local IP, "" for every node
+	logger        *slog.Logger
+	metrics       *Metrics
+	limiter       *connLimiter
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// Set the start nodes used to bootstrap the node table, as IPs or
+// host names with an optional port
+func WithStartIPs(ips ...string) Option {
+	return func(c *Client) {
+		c.settings.StartIPs = append([]string(nil), ips...)
+	}
+}
+
+// Set the number of nodes asked by each query
+func WithQuerySize(n int) Option {
+	return func(c *Client) {
+		c.settings.QuerySize = n
+	}
+}
+
+// Set the connections per second and the burst allowed to a single node,
+// a negative rate disables the limit
+func WithRateLimit(rate float64, burst int) Option {
+	return func(c *Client) {
+		c.settings.NodeRateLimit = rate
+		c.settings.NodeRateBurst = burst
+	}
+}
+
+// Set how many connections the client keeps open at the same time,
+// a negative n disables the limit
+func WithMaxConnections(n int) Option {
+	return func(c *Client) {
+		c.settings.MaxConnections = n
+	}
+}
+
+// Set how many rounds ExpandIPs walks the peer lists
+func WithExpandDepth(depth int) Option {
+	return func(c *Client) {
+		c.settings.IPExpandDepth = depth
+	}
+}
+
+// Force queries to only use the start IPs
+func WithForceQueryStartIPs(force bool) Option {
+	return func(c *Client) {
+		c.settings.ForceQueryStartIPs = force
+	}
+}
+
+// Load and save settings from path
+func WithSettingsPath(path string) Option {
+	return func(c *Client) {
+		c.settings_path = path
+	}
+}
+
+// Set the policy used to retry busy and NACK replies
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *Client) {
+		c.retry = policy
+	}
+}
+
+// Set the timeouts of the socket operations
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(c *Client) {
+		c.timeouts = timeouts
+	}
+}
+
+// Set the deadline of a whole query, retries included. By default it is
+// long enough for every attempt of the retry policy to run into the
+// socket timeouts, see WithTimeouts.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.query_timeout = timeout
+	}
+}
+
+// Set the dialer used to connect to the nodes, such as a SOCKS5Dialer
+func WithDialer(dialer Dialer) Option {
+	return func(c *Client) {
+		c.dialer = dialer
+	}
+}
+
+// Bind the connections to node to the local IP address local.
+// An empty node binds the connections to every node without a binding.
+// node is matched in its NormalizeNode form.
+func WithSourceAddress(node string, local string) Option {
+	return func(c *Client) {
+		if c.source_addrs == nil {
+			c.source_addrs = make(map[string]string)
+		}
+		if node != "" {
+			node = NormalizeNode(node)
+		}
+		c.source_addrs[node] = local
+	}
+}
+
+// Record every session to a file in dir, see RecordingConn
+func WithRecordDir(dir string) Option {
+	return func(c *Client) {
+		c.record_dir = dir
+	}
+}
+
+// Call fn with the final outcome of every node asked by a query
+func WithOutcomeHandler(fn func(NodeOutcome)) Option {
+	return func(c *Client) {
+		c.on_outcome = fn
+	}
 }
 
-// load settings from settings.json
-func LoadSettings() SettingsType {
-	file, err := os.Open("settings.json")
+// Log connections, frames and node failures to logger.
+// The client is silent without it.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// Record node operations, frame failures and quorum failures in metrics.
+// The metrics are part of the snapshot of Client.Collect.
+func WithMetrics(metrics *Metrics) Option {
+	return func(c *Client) {
+		c.metrics = metrics
+	}
+}
+
+// Create a new Client. If a settings path is given the settings are loaded
+// from it first and the other options are applied on top.
+func NewClient(opts ...Option) (*Client, error) {
+	c := &Client{
+		settings: SettingsType{
+			IPExpandDepth:  DEFAULT_EXPAND_DEPTH,
+			QuerySize:      DEFAULT_QUERY_SIZE,
+			NodeRateLimit:  DEFAULT_NODE_RATE_LIMIT,
+			NodeRateBurst:  DEFAULT_NODE_RATE_BURST,
+			MaxConnections: DEFAULT_MAX_CONNECTIONS,
+		},
+		retry: DefaultRetryPolicy,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.settings_path != "" {
+		settings, err := LoadSettings(c.settings_path)
+		if err == nil {
+			c.settings = settings
+			// options take precedence over the file
+			for _, opt := range opts {
+				opt(c)
+			}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	c.settings.normalize()
+	c.limiter = newConnLimiter(c.settings.NodeRateLimit, c.settings.NodeRateBurst, c.settings.MaxConnections)
+	return c, nil
+}
+
+// Normalize the node entries, so that the same node is always the same string,
+// and fill the connection limits left at 0
+func (s *SettingsType) normalize() {
+	for i := range s.StartIPs {
+		s.StartIPs[i] = NormalizeNode(s.StartIPs[i])
+	}
+	for i := range s.IPs {
+		s.IPs[i] = NormalizeNode(s.IPs[i])
+	}
+	for i := range s.Nodes {
+		s.Nodes[i].IP = NormalizeNode(s.Nodes[i].IP)
+	}
+	// settings files written before the limits existed
+	if s.NodeRateLimit == 0 {
+		s.NodeRateLimit = DEFAULT_NODE_RATE_LIMIT
+	}
+	if s.NodeRateBurst == 0 {
+		s.NodeRateBurst = DEFAULT_NODE_RATE_BURST
+	}
+	if s.MaxConnections == 0 {
+		s.MaxConnections = DEFAULT_MAX_CONNECTIONS
+	}
+}
+
+// load settings from path
+func LoadSettings(path string) (SettingsType, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		fmt.Println("Error opening settings.json")
+		return SettingsType{}, err
 	}
 	defer file.Close()
 
@@ -39,180 +274,222 @@ func LoadSettings() SettingsType {
 	settings := SettingsType{}
 	err = decoder.Decode(&settings)
 	if err != nil {
-		fmt.Println("Error decoding settings.json")
+		return SettingsType{}, fmt.Errorf("decoding %s: %w", path, err)
 	}
-	return settings
+	return settings, nil
 }
 
-// save settings to settings.json
-func SaveSettings(settings SettingsType) {
-	file, err := os.Create("settings.json")
+// save settings to path
+func SaveSettings(path string, settings SettingsType) error {
+	file, err := os.Create(path)
 	if err != nil {
-		fmt.Println("Error creating settings.json")
+		return err
 	}
 	defer file.Close()
 	// format with indentation
 	encoder := json.NewEncoder(file)
 	encoder.SetIndent("", "    ")
 	err = encoder.Encode(settings)
-
 	if err != nil {
-		fmt.Println("Error encoding settings.json")
+		return fmt.Errorf("encoding %s: %w", path, err)
+	}
+	return nil
+}
+
+// Save the client settings to the settings path
+func (c *Client) SaveSettings() error {
+	if c.settings_path == "" {
+		return fmt.Errorf("no settings path configured")
 	}
+	return SaveSettings(c.settings_path, c.Settings())
+}
+
+// Get a copy of the client settings
+func (c *Client) Settings() SettingsType {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	settings := c.settings
+	settings.StartIPs = append([]string(nil), c.settings.StartIPs...)
+	settings.IPs = append([]string(nil), c.settings.IPs...)
+	settings.Nodes = append([]RemoteNode(nil), c.settings.Nodes...)
+	return settings
 }
 
 // Expand known IPs
-func ExpandIPs() {
+func (c *Client) ExpandIPs(ctx context.Context) error {
+	c.mu.Lock()
 	// Add start IPs to the settings IPs
-	Settings.IPs = append(Settings.IPs, Settings.StartIPs...)
+	known := append(append([]string(nil), c.settings.IPs...), c.settings.StartIPs...)
+	depth := c.settings.IPExpandDepth
+	c.mu.Unlock()
+
 	queriedIPs := make(map[string]bool)
 
-	for i := 0; i < Settings.IPExpandDepth; i++ {
+	for i := 0; i < depth; i++ {
+		var mu sync.Mutex
 		ips := make([]string, 0)
-		ch := make(chan string)
+		// Add new IPs to the list if they are not already present
+		add := func(new_ip string) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ip := range ips {
+				if new_ip == ip {
+					return
+				}
+			}
+			ips = append(ips, new_ip)
+		}
 
-		for _, ip := range Settings.IPs {
+		round_ctx, cancel := context.WithTimeout(ctx, c.queryTimeout())
+		var wg sync.WaitGroup
+		for _, ip := range known {
 			if queriedIPs[ip] {
 				continue // Skip already queried IPs
 			}
 			queriedIPs[ip] = true
 
+			wg.Add(1)
 			go func(ip string) {
-				sd := ConnectToNode(ip)
-				if sd.block_num == 0 {
-					fmt.Println("Connection failed")
-					ch <- ""
+				defer wg.Done()
+				sd, _, err := c.connect(round_ctx, ip)
+				if err != nil {
+					c.log().Warn("connection failed", "node", ip, "err", err)
 					return
 				}
-				new_ips, err := sd.GetIPList()
+				defer sd.Close()
+				new_ips, err := sd.GetIPList(round_ctx)
 				if err != nil {
-					fmt.Println("Error:", err)
-					ch <- ""
+					c.log().Warn("peer list failed", "node", ip, "err", err)
 					return
 				}
-				// Add new IPs to the list if they are not already present
 				for _, new_ip := range new_ips {
-					found := false
-					for _, ip := range ips {
-						if new_ip == ip {
-							found = true
-							break
-						}
-					}
-					if !found {
-						ips = append(ips, new_ip)
-					}
+					add(NormalizeNode(new_ip))
 				}
-				ch <- ip
+				add(ip)
 			}(ip)
 		}
 
-		timeout := time.After(5 * time.Second)
-		for range Settings.IPs {
-			select {
-			case ip := <-ch:
-				if ip != "" {
-					ips = append(ips, ip)
-				}
-			case <-timeout:
-				fmt.Println("Timeout")
-				return
-			}
+		wg.Wait()
+		cancel()
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		Settings.IPs = ips
+		known = ips
+		c.mu.Lock()
+		c.settings.IPs = append([]string(nil), ips...)
+		c.mu.Unlock()
 	}
+	return nil
 }
 
-// Benchmark all IPs in the time they take to ConnectToNode
-func BenchmarkNodes(n int) {
-	ch := make(chan RemoteNode)
+// Benchmark all IPs in the time they take to ConnectToNode. Each node has
+// the time of one attempt to answer, a cancelled ctx stops the benchmark
+// and is returned.
+func (c *Client) BenchmarkNodes(ctx context.Context, n int) error {
+	c.mu.RLock()
+	all_ips := append([]string(nil), c.settings.IPs...)
+	c.mu.RUnlock()
 
-	for i := 0; i < len(Settings.IPs); i += n {
-		end := i + n
-		if end > len(Settings.IPs) {
-			end = len(Settings.IPs)
-		}
-		ips := Settings.IPs[i:end]
-
-		for _, ip := range ips {
-			go func(ip string) {
-				start := time.Now()
-				sd := ConnectToNode(ip)
-				ping := time.Since(start)
-				if sd.block_num == 0 {
-					fmt.Println("Connection failed")
-					ping = 10 * time.Second
-				}
-				// ping in milliseconds
-				ch <- RemoteNode{IP: ip, Ping: uint32(ping / time.Millisecond)}
-			}(ip)
-		}
+	if n <= 0 {
+		n = 1
 	}
+	timeout := c.attemptTimeout()
 
-	timeout := time.After(5 * time.Second) // Set timeout of 5 seconds
+	// Limit to n concurrent pings
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
 
-	for i := 0; i < len(Settings.IPs); i += n {
-		end := i + n
-		if end > len(Settings.IPs) {
-			end = len(Settings.IPs)
-		}
-		ips := Settings.IPs[i:end]
-
-		for range ips {
+	for _, ip := range all_ips {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
 			select {
-			case node := <-ch:
-				found := false
-				for i, n := range Settings.Nodes {
-					if n.IP == node.IP {
-						Settings.Nodes[i].Ping = (n.Ping*2 + node.Ping) / 3
-						Settings.Nodes[i].LastSeen = time.Now()
-						found = true
-						break
-					}
-				}
-				if !found {
-					Settings.Nodes = append(Settings.Nodes, node)
-				}
-			case <-timeout:
-				fmt.Println("Timeout")
+			case sem <- struct{}{}:
+			case <-ctx.Done():
 				return
 			}
-		}
+			defer func() { <-sem }()
+
+			node_ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			sd, ping, err := c.connect(node_ctx, ip)
+			if ctx.Err() != nil {
+				// not the node's fault
+				return
+			}
+			address := ""
+			if err != nil {
+				c.log().Warn("connection failed", "node", ip, "err", err)
+				ping = 10 * time.Second
+			} else {
+				address = sd.Address
+				sd.Close()
+			}
+			// ping in milliseconds
+			c.updateNode(RemoteNode{IP: ip, Address: address, Ping: uint32(ping / time.Millisecond), LastSeen: time.Now()})
+		}(ip)
 	}
+	wg.Wait()
+	return ctx.Err()
+}
 
-	close(ch)
+// Merge a benchmarked node into the node table
+func (c *Client) updateNode(node RemoteNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, n := range c.settings.Nodes {
+		if n.IP == node.IP {
+			c.settings.Nodes[i].Ping = (n.Ping*2 + node.Ping) / 3
+			c.settings.Nodes[i].LastSeen = node.LastSeen
+			if node.Address != "" {
+				c.settings.Nodes[i].Address = node.Address
+			}
+			return
+		}
+	}
+	c.settings.Nodes = append(c.settings.Nodes, node)
 }
 
-// Pick n random nodes from Settings.Nodes
-// the probability of picking a node is e**(-ping)
-func PickNodes(n int) []RemoteNode {
+// Pick n random nodes from the node table that serve all of ops,
+// the probability of picking a node is e**(-ping).
+// Nodes that were never identified are assumed to serve every opcode.
+func (c *Client) PickNodes(n int, ops ...uint16) []RemoteNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	// if forcequerystartips is set, return the nodes with ip startip
-	if Settings.ForceQueryStartIPs {
+	if c.settings.ForceQueryStartIPs {
 		nodes := make([]RemoteNode, 0)
-		for _, node := range Settings.Nodes {
-			if node.IP == Settings.StartIPs[0] {
-				nodes = append(nodes, node)
-			}
+		for _, ip := range c.settings.StartIPs {
+			nodes = append(nodes, RemoteNode{IP: ip})
 		}
 		return nodes
 	}
 
-	if n >= len(Settings.Nodes) {
-		return Settings.Nodes
+	candidates := make([]RemoteNode, 0, len(c.settings.Nodes))
+	for _, node := range c.settings.Nodes {
+		if node.serves(ops) {
+			candidates = append(candidates, node)
+		}
+	}
+	if n >= len(candidates) {
+		return candidates
 	}
 
 	nodes := make([]RemoteNode, 0)
 	for i := 0; i < n; i++ {
 		// calculate the sum of e**(-ping) for all nodes
 		sum := 0.0
-		for _, node := range Settings.Nodes {
+		for _, node := range candidates {
 			sum += math.Exp(-1 / float64(node.Ping/2))
 		}
 		// pick a random number between 0 and sum
 		r := sum * rand.Float64()
 		// find the node that corresponds to the random number
-		for _, node := range Settings.Nodes {
+		for _, node := range candidates {
 			r -= math.Exp(-1 / float64(node.Ping/2))
 			if r <= 0 {
 				// if it is already in the list, decrease i and continue
@@ -234,79 +511,372 @@ func PickNodes(n int) []RemoteNode {
 	return nodes
 }
 
-// Query the balance of an address given as hex
-func QueryBalance(wots_address string) (uint64, error) {
-	wots_addr := WotsAddressFromHex(wots_address)
+// Get the number of nodes asked by each query
+func (c *Client) querySize() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.settings.QuerySize
+}
 
-	// connect to a random node
-	nodes := PickNodes(Settings.QuerySize)
-	balances := make([]WotsAddress, 0)
+// Get the retry policy of the client
+func (c *Client) retryPolicy() RetryPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.retry
+}
 
-	// Ask for result on the same time
-	ch := make(chan WotsAddress)
+// Get the time one attempt may take to dial, handshake and run an operation
+func (c *Client) attemptTimeout() time.Duration {
+	c.mu.RLock()
+	timeouts := c.timeouts.withDefaults()
+	c.mu.RUnlock()
+	return timeouts.Dial + timeouts.Handshake + timeouts.Op
+}
 
-	for _, node := range nodes {
-		go func(node RemoteNode) {
-			sd := ConnectToNode(node.IP)
-			if sd.block_num == 0 {
-				fmt.Println("Connection failed")
-				ch <- WotsAddress{}
-				return
+// Get the deadline of a query: the one set with WithQueryTimeout, or the
+// time taken by every attempt of the retry policy to dial, handshake and
+// run an operation until the timeouts, plus the backoff between them
+func (c *Client) queryTimeout() time.Duration {
+	c.mu.RLock()
+	query_timeout, policy := c.query_timeout, c.retry
+	c.mu.RUnlock()
+	if query_timeout > 0 {
+		return query_timeout
+	}
+	attempt := c.attemptTimeout()
+	// the jitter only shortens the backoff
+	policy.Jitter = 0
+	timeout := attempt
+	for i := 1; i < policy.MaxAttempts; i++ {
+		timeout += policy.Backoff(i) + attempt
+	}
+	return timeout
+}
+
+// Get the nodes of the table that are not in picked and serve all of ops,
+// fastest first. If ForceQueryStartIPs is set only the start IPs are spares.
+func (c *Client) spareNodes(picked []RemoteNode, ops ...uint16) []RemoteNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	candidates := c.settings.Nodes
+	if c.settings.ForceQueryStartIPs {
+		candidates = make([]RemoteNode, 0, len(c.settings.StartIPs))
+		for _, ip := range c.settings.StartIPs {
+			candidates = append(candidates, RemoteNode{IP: ip})
+		}
+	}
+
+	spares := make([]RemoteNode, 0)
+	for _, node := range candidates {
+		if !node.serves(ops) {
+			continue
+		}
+		found := false
+		for _, p := range picked {
+			if p.IP == node.IP {
+				found = true
+				break
 			}
-			// get the balance of the wots_addr GetBalance
-			balance, err := sd.GetBalance(wots_addr)
-			if err != nil {
-				fmt.Println("Error:", err)
-				ch <- WotsAddress{}
-				return
+		}
+		if !found {
+			spares = append(spares, node)
+		}
+	}
+	sort.Slice(spares, func(i, j int) bool {
+		return spares[i].Ping < spares[j].Ping
+	})
+	return spares
+}
+
+// Result of a query slot
+type nodeResult[T any] struct {
+	value   T
+	outcome NodeOutcome
+}
+
+// Run fn on n picked nodes serving op at the same time. Busy and NACK replies are
+// retried according to the retry policy, on the same node or on a spare one.
+func queryNodes[T any](ctx context.Context, c *Client, n int, op uint16, fn func(context.Context, *SocketData) (T, error)) []nodeResult[T] {
+	nodes := c.PickNodes(n, op)
+	policy := c.retryPolicy()
+
+	var mu sync.Mutex
+	spares := c.spareNodes(nodes, op)
+	// Take the next spare node, or keep the current one if none is left
+	next_node := func(current RemoteNode) RemoteNode {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(spares) == 0 {
+			return current
+		}
+		node := spares[0]
+		spares = spares[1:]
+		return node
+	}
+
+	results := make([]nodeResult[T], len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node RemoteNode) {
+			defer wg.Done()
+			start := time.Now()
+			var result nodeResult[T]
+			for {
+				result.outcome.Attempts++
+				result.outcome.IP = node.IP
+				result.value, result.outcome.Err = queryNode(ctx, c, node, fn)
+				if result.outcome.Err == nil || !isRetryable(result.outcome.Err) {
+					break
+				}
+				if result.outcome.Attempts >= policy.MaxAttempts {
+					break
+				}
+				if sleepContext(ctx, policy.Backoff(result.outcome.Attempts)) != nil {
+					break
+				}
+				if policy.SwitchNode {
+					node = next_node(node)
+				}
+			}
+			result.outcome.Duration = time.Since(start)
+			results[i] = result
+			if result.outcome.Err != nil {
+				c.log().Warn("node failed", "node", result.outcome.IP, "attempts", result.outcome.Attempts,
+					"duration", result.outcome.Duration, "err", result.outcome.Err)
+			} else {
+				c.log().Debug("node answered", "node", result.outcome.IP, "attempts", result.outcome.Attempts,
+					"duration", result.outcome.Duration)
 			}
-			wots_addr.Amount = balance
-			ch <- wots_addr
-		}(node)
+			if c.on_outcome != nil {
+				c.on_outcome(result.outcome)
+			}
+		}(i, node)
+	}
+	wg.Wait()
+	return results
+}
+
+// Get the logger of the client, silent if none is set
+func (c *Client) log() *slog.Logger {
+	if c.logger == nil {
+		return discard_logger
+	}
+	return c.logger
+}
+
+// Connect to a node with the client configuration and complete the handshake,
+// waiting for the connection limits first. The time taken to dial and
+// handshake, without the wait, is returned with the connection.
+// The caller must Close the returned SocketData.
+func (c *Client) connect(ctx context.Context, ip string) (*SocketData, time.Duration, error) {
+	sd := &SocketData{IP: ip, Timeouts: c.timeouts, Dialer: c.dialer, Logger: c.logger, Metrics: c.metrics}
+	local, ok := c.source_addrs[NormalizeNode(ip)]
+	if !ok {
+		local, ok = c.source_addrs[""]
+	}
+	if ok {
+		dialer, err := bindDialer(c.dialer, local)
+		if err != nil {
+			return nil, 0, err
+		}
+		sd.Dialer = dialer
+	}
+	if c.limiter != nil {
+		start := time.Now()
+		release, err := c.limiter.wait(ctx, ip)
+		if err != nil {
+			return nil, 0, err
+		}
+		if waited := time.Since(start); waited > time.Millisecond {
+			c.log().Debug("connection delayed by the limits", "node", ip, "duration", waited)
+		}
+		// the slot is held until Close
+		sd.release = release
+	}
+	start := time.Now()
+	err := sd.Connect(ctx)
+	if err != nil {
+		sd.Close()
+		return nil, 0, err
+	}
+	if c.record_dir != "" {
+		file, err := createRecordingFile(c.record_dir, ip)
+		if err != nil {
+			sd.Close()
+			return nil, 0, err
+		}
+		sd.Conn = NewRecordingConn(sd.Conn, file)
 	}
+	err = sd.Hello(ctx)
+	if err != nil {
+		sd.Close()
+		return nil, 0, err
+	}
+	c.setNodeAddress(ip, sd.Address)
+	return sd, time.Since(start), nil
+}
 
-	timeout := time.After(5 * time.Second) // Set timeout of 5 seconds
+// Keep the resolved address of a node in the node table
+func (c *Client) setNodeAddress(ip string, address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.settings.Nodes {
+		if c.settings.Nodes[i].IP == ip {
+			c.settings.Nodes[i].Address = address
+			return
+		}
+	}
+}
+
+// Connect to node and run fn on it
+func queryNode[T any](ctx context.Context, c *Client, node RemoteNode, fn func(context.Context, *SocketData) (T, error)) (T, error) {
+	sd, _, err := c.connect(ctx, node.IP)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer sd.Close()
+	return fn(ctx, sd)
+}
 
-	for range nodes {
-		select {
-		case balance := <-ch:
-			if balance.Amount != 0 {
-				balances = append(balances, balance)
+// Find the value returned by at least quorum nodes. If there is none, the
+// error returned by at least quorum nodes is checked against known, so that
+// an agreed answer such as ErrAddressNotFound is not reported as no quorum.
+func quorumValue[T comparable](results []nodeResult[T], quorum int, query string, known ...error) (T, error) {
+	counts := make(map[T]int)
+	for _, result := range results {
+		if result.outcome.Err == nil {
+			counts[result.value]++
+		}
+	}
+	for value, count := range counts {
+		if count >= quorum {
+			return value, nil
+		}
+	}
+
+	var zero T
+	for _, target := range known {
+		count := 0
+		for _, result := range results {
+			if errors.Is(result.outcome.Err, target) {
+				count++
 			}
-		case <-timeout:
-			fmt.Println("Timeout")
-			return 0, fmt.Errorf("timeout")
+		}
+		if count >= quorum {
+			return zero, target
 		}
 	}
 
-	close(ch)
+	outcomes := make([]NodeOutcome, len(results))
+	for i, result := range results {
+		outcomes[i] = result.outcome
+	}
+	return zero, &QuorumError{Query: query, Quorum: quorum, Outcomes: outcomes}
+}
 
-	// Calculate the most frequent balance
-	counts := make(map[uint64]int)
-	for _, balance := range balances {
-		counts[balance.Amount]++
+// Query the balance of an address given as hex of TXADDRLEN bytes
+func (c *Client) QueryBalance(ctx context.Context, wots_address string) (uint64, error) {
+	address, err := hex.DecodeString(wots_address)
+	if err != nil {
+		return 0, fmt.Errorf("decoding address: %w", err)
+	}
+	if len(address) != TXADDRLEN {
+		return 0, &LengthError{Type: "address", Expected: TXADDRLEN, Received: len(address)}
 	}
+	wots_addr := WotsAddressFromBytes(address)
+
+	ctx, cancel := context.WithTimeout(ctx, c.queryTimeout())
+	defer cancel()
+
+	// Ask random nodes on the same time
+	query_size := c.querySize()
+	results := queryNodes(ctx, c, query_size, OP_BALANCE, func(ctx context.Context, sd *SocketData) (uint64, error) {
+		return sd.GetBalance(ctx, wots_addr)
+	})
 
 	// See if there is a balance that reaches quorum
+	balance, err := quorumValue(results, query_size/2+1, "balance", ErrAddressNotFound)
+	if errors.Is(err, ErrNoQuorum) {
+		c.metrics.observeQuorumFailure("balance")
+	}
+	return balance, err
+}
 
-	max_balance := uint64(0)
-	for balance, count := range counts {
-		if count >= Settings.QuerySize/2+1 {
-			max_balance = balance
-			break
-		}
+// Resolve a tag of TXTAGLEN bytes on QuerySize nodes, the quorum must agree
+// on the full address and its balance.
+// ErrTagNotFound is returned if the quorum does not know the tag.
+func (c *Client) QueryResolveTag(ctx context.Context, tag []byte) (WotsAddress, error) {
+	if len(tag) != TXTAGLEN {
+		return WotsAddress{}, &LengthError{Type: "tag", Expected: TXTAGLEN, Received: len(tag)}
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.queryTimeout())
+	defer cancel()
+
+	query_size := c.querySize()
+	results := queryNodes(ctx, c, query_size, OP_RESOLVE, func(ctx context.Context, sd *SocketData) (WotsAddress, error) {
+		return sd.ResolveTag(ctx, tag)
+	})
+
+	// WotsAddress holds the address and the balance, both must agree
+	wots_addr, err := quorumValue(results, query_size/2+1, "tag resolution", ErrTagNotFound)
+	if errors.Is(err, ErrNoQuorum) {
+		c.metrics.observeQuorumFailure("resolve_tag")
 	}
+	return wots_addr, err
+}
 
-	// If no balance reaches quorum, return 0
-	if max_balance == 0 {
-		return 0, fmt.Errorf("no balance reaches quorum")
+// Resolve a tag given as hex, see QueryResolveTag
+func (c *Client) QueryResolveTagHex(ctx context.Context, tag_hex string) (WotsAddress, error) {
+	tag, err := hex.DecodeString(tag_hex)
+	if err != nil {
+		return WotsAddress{}, fmt.Errorf("decoding tag: %w", err)
 	}
+	return c.QueryResolveTag(ctx, tag)
+}
 
-	// Save the most frequent balance to the wots_address
-	wots_addr.Amount = max_balance
-	//fmt.Println("Wots address:", wots_addr)
+// Query the hash of block block_num, as agreed by the quorum of QuerySize nodes.
+// ErrBlockNotFound is returned if the quorum does not have the block.
+func (c *Client) QueryBlockHash(ctx context.Context, block_num uint64) ([HASHLEN]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.queryTimeout())
+	defer cancel()
 
-	return max_balance, nil
+	query_size := c.querySize()
+	results := queryNodes(ctx, c, query_size, OP_HASH, func(ctx context.Context, sd *SocketData) ([HASHLEN]byte, error) {
+		return sd.GetBlockHash(ctx, block_num)
+	})
+
+	hash, err := quorumValue(results, query_size/2+1, "block hash", ErrBlockNotFound)
+	if errors.Is(err, ErrNoQuorum) {
+		c.metrics.observeQuorumFailure("block_hash")
+	}
+	return hash, err
 }
 
-//
+// Get a snapshot of the node table gauges and of the metrics set with
+// WithMetrics, for WriteMetrics or MetricsHandler
+func (c *Client) Collect() []MetricFamily {
+	c.mu.RLock()
+	nodes := append([]RemoteNode(nil), c.settings.Nodes...)
+	ips := len(c.settings.IPs)
+	c.mu.RUnlock()
+
+	known := MetricFamily{Name: "mcm_known_ips", Help: "IPs discovered by ExpandIPs.", Type: "gauge",
+		Samples: []Sample{{Name: "mcm_known_ips", Value: float64(ips)}}}
+	table := MetricFamily{Name: "mcm_nodes", Help: "Nodes in the node table.", Type: "gauge",
+		Samples: []Sample{{Name: "mcm_nodes", Value: float64(len(nodes))}}}
+	ping := MetricFamily{Name: "mcm_node_ping_seconds", Help: "Last connection time measured by BenchmarkNodes.", Type: "gauge"}
+	seen := MetricFamily{Name: "mcm_node_last_seen_timestamp_seconds", Help: "Unix time of the last benchmark of the node.", Type: "gauge"}
+	for _, node := range nodes {
+		labels := []Label{{"node", node.IP}}
+		ping.Samples = append(ping.Samples, Sample{Name: ping.Name, Labels: labels, Value: float64(node.Ping) / 1000})
+		if !node.LastSeen.IsZero() {
+			seen.Samples = append(seen.Samples, Sample{Name: seen.Name, Labels: labels, Value: float64(node.LastSeen.Unix())})
+		}
+	}
+	sortSamples(ping.Samples)
+	sortSamples(seen.Samples)
+	return append([]MetricFamily{known, table, ping, seen}, c.metrics.Collect()...)
+}
@@ -0,0 +1,208 @@
+package mcminterface
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	client, err := NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// three attempts of dial, handshake and op, and two backoffs
+	want := 3*(DefaultTimeouts.Dial+DefaultTimeouts.Handshake+DefaultTimeouts.Op) + 250*time.Millisecond + 500*time.Millisecond
+	if got := client.queryTimeout(); got != want {
+		t.Errorf("default query timeout %v, want %v", got, want)
+	}
+
+	client, _ = NewClient(WithTimeouts(Timeouts{Dial: time.Second, Handshake: time.Second, Op: time.Second}),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	if got := client.queryTimeout(); got != 3*time.Second {
+		t.Errorf("query timeout %v with a single attempt, want 3s", got)
+	}
+
+	client, _ = NewClient(WithQueryTimeout(time.Minute))
+	if got := client.queryTimeout(); got != time.Minute {
+		t.Errorf("query timeout %v, want the 1m set", got)
+	}
+}
+
+// Start a node that accepts connections and never answers, it is closed
+// when the test ends
+func startSilentNode(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestQueryTimeoutSilentNode(t *testing.T) {
+	client := newMockClient(t, []string{startSilentNode(t)}, WithQueryTimeout(100*time.Millisecond))
+	var address [TXADDRLEN]byte
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.QueryBalance(context.Background(), hex.EncodeToString(address[:]))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("query of a silent node succeeded")
+		}
+	case <-time.After(DefaultTimeouts.Handshake):
+		t.Error("the query outlived its deadline")
+	}
+}
+
+// Create a client whose settings list addrs, for the sweeps of the node table
+func newTableClient(t *testing.T, addrs []string, opts ...Option) *Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "settings.json")
+	if err := SaveSettings(path, SettingsType{IPs: addrs, QuerySize: len(addrs)}); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(append([]Option{WithSettingsPath(path)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestBenchmarkNodesDeadline(t *testing.T) {
+	_, addrs := startMockNodes(t, 1, nil)
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startSilentNode(t))
+	}
+	// One node at a time, the silent ones take the whole attempt each.
+	// The query timeout is not a deadline for the sweep.
+	timeout := 100 * time.Millisecond
+	client := newTableClient(t, addrs, WithTimeouts(Timeouts{Dial: timeout, Handshake: timeout, Op: timeout}),
+		WithQueryTimeout(timeout/2))
+	if err := client.BenchmarkNodes(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	nodes := client.Settings().Nodes
+	if len(nodes) != len(addrs) {
+		t.Fatalf("%d nodes benchmarked, want %d", len(nodes), len(addrs))
+	}
+	for _, node := range nodes {
+		answered := node.Ping < 10000
+		if answered != (node.IP == addrs[0]) {
+			t.Errorf("%s has ping %dms", node.IP, node.Ping)
+		}
+	}
+	if err := client.IdentifyNodes(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range client.Settings().Nodes {
+		if identified := node.Identity != nil; identified != (node.IP == addrs[0]) {
+			t.Errorf("%s identified: %v", node.IP, identified)
+		}
+	}
+}
+
+func TestSweepCancelled(t *testing.T) {
+	_, addrs := startMockNodes(t, 2, nil)
+	client := newTableClient(t, addrs)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.BenchmarkNodes(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("BenchmarkNodes: got %v, want context.Canceled", err)
+	}
+	if nodes := client.Settings().Nodes; len(nodes) != 0 {
+		t.Errorf("cancelled benchmark recorded %v", nodes)
+	}
+
+	if err := client.BenchmarkNodes(context.Background(), 1); err != nil || len(client.Settings().Nodes) != 2 {
+		t.Fatalf("benchmark: %v, %d nodes", err, len(client.Settings().Nodes))
+	}
+	if err := client.IdentifyNodes(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("IdentifyNodes: got %v, want context.Canceled", err)
+	}
+}
+
+func TestQueryBlockHash(t *testing.T) {
+	chain := testChain(100)
+	fork := append([]BTRAILER(nil), chain...)
+	rand.Read(fork[50].Bhash[:])
+	other := append([]BTRAILER(nil), chain...)
+	rand.Read(other[50].Bhash[:])
+	nodes, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetTrailers(chain)
+	})
+	nodes[2].SetTrailers(fork)
+	client := newMockClient(t, addrs)
+	ctx := context.Background()
+
+	// Two nodes out of three agree
+	hash, err := client.QueryBlockHash(ctx, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != chain[50].Bhash {
+		t.Errorf("hash %x, want %x", hash, chain[50].Bhash)
+	}
+	if _, err := client.QueryBlockHash(ctx, 1000); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("missing block: got %v, want ErrBlockNotFound", err)
+	}
+	// Three different hashes
+	nodes[1].SetTrailers(other)
+	if _, err := client.QueryBlockHash(ctx, 50); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("got %v, want ErrNoQuorum", err)
+	}
+}
+
+func TestQueryResolveTag(t *testing.T) {
+	address := randomAddress()
+	wots_addr := WotsAddressFromBytes(address[:])
+	nodes, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetBalance(address, 1234567890)
+	})
+	client := newMockClient(t, addrs)
+	ctx := context.Background()
+
+	resolved, err := client.QueryResolveTagHex(ctx, hex.EncodeToString(wots_addr.GetTAG()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Address != address || resolved.GetAmount() != 1234567890 {
+		t.Errorf("resolved %x with %d, want %x with 1234567890", resolved.Address, resolved.GetAmount(), address)
+	}
+
+	var missing [TXTAGLEN]byte
+	if _, err := client.QueryResolveTag(ctx, missing[:]); !errors.Is(err, ErrTagNotFound) {
+		t.Errorf("missing tag: got %v, want ErrTagNotFound", err)
+	}
+	if _, err := client.QueryResolveTag(ctx, []byte{1, 2, 3}); !errors.Is(err, ErrInvalidLength) {
+		t.Errorf("short tag: got %v, want ErrInvalidLength", err)
+	}
+	if _, err := client.QueryResolveTagHex(ctx, "zz"); err == nil {
+		t.Error("tag with invalid hex resolved")
+	}
+
+	// Nodes agreeing on the address but not on the balance
+	nodes[1].SetBalance(address, 1)
+	nodes[2].SetBalance(address, 2)
+	if _, err := client.QueryResolveTag(ctx, wots_addr.GetTAG()); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("got %v, want ErrNoQuorum", err)
+	}
+}
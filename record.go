@@ -0,0 +1,227 @@
+package mcminterface
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReplayMismatch is returned when the client diverges from a replayed session
+var ErrReplayMismatch = errors.New("replay mismatch")
+
+// RecordedFrame is a TX frame of a recorded session, stored as a JSON line
+type RecordedFrame struct {
+	Time  time.Time
+	Sent  bool   // sent by us, else received from the node
+	Frame []byte // TX_LEN bytes
+}
+
+// RecordingConn wraps a connection and records every TX frame sent and
+// received on it, with timestamps, as JSON lines
+type RecordingConn struct {
+	net.Conn
+	mu   sync.Mutex
+	enc  *json.Encoder
+	w    io.Writer
+	sent []byte // partial frames
+	recv []byte
+	err  error // first recording error
+}
+
+// Wrap conn to record its frames into w. If w is an io.Closer it is
+// closed with the connection.
+func NewRecordingConn(conn net.Conn, w io.Writer) *RecordingConn {
+	return &RecordingConn{Conn: conn, enc: json.NewEncoder(w), w: w}
+}
+
+// Write to the connection and record the frames written
+func (r *RecordingConn) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	r.record(&r.sent, p[:n], true)
+	return n, err
+}
+
+// Read from the connection and record the frames read
+func (r *RecordingConn) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.record(&r.recv, p[:n], false)
+	return n, err
+}
+
+// Close the connection and the recording
+func (r *RecordingConn) Close() error {
+	err := r.Conn.Close()
+	if closer, ok := r.w.(io.Closer); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Get the first error hit while writing the recording
+func (r *RecordingConn) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Buffer p and write out every complete frame
+func (r *RecordingConn) record(partial *[]byte, p []byte, sent bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*partial = append(*partial, p...)
+	for len(*partial) >= TX_LEN {
+		frame := RecordedFrame{Time: time.Now(), Sent: sent, Frame: append([]byte(nil), (*partial)[:TX_LEN]...)}
+		*partial = (*partial)[TX_LEN:]
+		if err := r.enc.Encode(&frame); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+}
+
+// Read a recording written by RecordingConn
+func LoadRecording(r io.Reader) ([]RecordedFrame, error) {
+	frames := make([]RecordedFrame, 0)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var frame RecordedFrame
+		err := dec.Decode(&frame)
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(frame.Frame) != TX_LEN {
+			return nil, &LengthError{Type: "recorded frame", Expected: TX_LEN, Received: len(frame.Frame)}
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// Create the file of a new recording of node in dir
+func createRecordingFile(dir string, node string) (*os.File, error) {
+	name := strings.NewReplacer(":", "_", "/", "_", "[", "", "]", "").Replace(node)
+	return os.Create(filepath.Join(dir, fmt.Sprintf("%s-%d.mcmrec", name, time.Now().UnixNano())))
+}
+
+// ReplayConn is a net.Conn serving a recorded session back to the client.
+// Received frames are replayed in order with ID1 rewritten to the one the
+// client sent, so that the session validates. The opcodes sent by the
+// client must match the recording. Deadlines are ignored.
+type ReplayConn struct {
+	mu     sync.Mutex
+	frames []RecordedFrame
+	next   int    // next recorded frame
+	sent   []byte // partial frame written by the client
+	recv   []byte // rest of the frame being read
+	id1    [2]byte
+	closed bool
+}
+
+// Create a connection replaying frames
+func NewReplayConn(frames []RecordedFrame) *ReplayConn {
+	return &ReplayConn{frames: frames}
+}
+
+// Open a recording file and return a SocketData replaying it, not yet
+// handshaked: call Hello and then the operations of the recorded session
+func OpenReplay(path string) (*SocketData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	frames, err := LoadRecording(file)
+	if err != nil {
+		return nil, err
+	}
+	return &SocketData{IP: path, Conn: NewReplayConn(frames)}, nil
+}
+
+// Consume the frames written by the client and check them against the recording
+func (r *ReplayConn) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, net.ErrClosed
+	}
+	r.sent = append(r.sent, p...)
+	for len(r.sent) >= TX_LEN {
+		frame := r.sent[:TX_LEN]
+		if r.next >= len(r.frames) || !r.frames[r.next].Sent {
+			return len(p), fmt.Errorf("%w: unexpected frame %s", ErrReplayMismatch, OpcodeName(binary.LittleEndian.Uint16(frame[8:10])))
+		}
+		recorded := r.frames[r.next].Frame
+		if string(frame[8:10]) != string(recorded[8:10]) {
+			return len(p), fmt.Errorf("%w: sent %s, recorded %s", ErrReplayMismatch,
+				OpcodeName(binary.LittleEndian.Uint16(frame[8:10])), OpcodeName(binary.LittleEndian.Uint16(recorded[8:10])))
+		}
+		copy(r.id1[:], frame[4:6])
+		r.sent = r.sent[TX_LEN:]
+		r.next++
+	}
+	return len(p), nil
+}
+
+// Serve the next recorded frame, io.EOF once the recording is over
+func (r *ReplayConn) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, net.ErrClosed
+	}
+	if len(r.recv) == 0 {
+		if r.next >= len(r.frames) {
+			return 0, io.EOF
+		}
+		if r.frames[r.next].Sent {
+			return 0, fmt.Errorf("%w: read while the recording expects a write", ErrReplayMismatch)
+		}
+		frame := r.frames[r.next].Frame
+		var tx TX
+		tx.UnmarshalBinary(frame)
+		tx.ID1 = r.id1
+		// A recorded crc16 failure is replayed as such
+		if frameCRC16(frame) == binary.LittleEndian.Uint16(frame[TX_CRC_LEN:]) {
+			tx.computeCRC16()
+		}
+		r.recv, _ = tx.MarshalBinary()
+		r.next++
+	}
+	n := copy(p, r.recv)
+	r.recv = r.recv[n:]
+	return n, nil
+}
+
+// Close the replay
+func (r *ReplayConn) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *ReplayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (r *ReplayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (r *ReplayConn) SetDeadline(t time.Time) error      { return nil }
+func (r *ReplayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (r *ReplayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Address of a replayed connection
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
@@ -0,0 +1,45 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	address := randomAddress()
+	nodes, addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetBalance(address, 987654321)
+	})
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	client := newMockClient(t, addrs, WithRecordDir(dir))
+	balance, err := client.QueryBalance(ctx, hex.EncodeToString(address[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].Close()
+
+	// Replay with the node gone
+	files, _ := filepath.Glob(filepath.Join(dir, "*.mcmrec"))
+	if len(files) != 1 {
+		t.Fatalf("%d recordings, want 1", len(files))
+	}
+	sd, err := OpenReplay(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Close()
+	if err := sd.Hello(ctx); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := sd.GetBalance(ctx, WotsAddressFromBytes(address[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != balance {
+		t.Errorf("replayed balance %d, recorded %d", replayed, balance)
+	}
+}
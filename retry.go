@@ -0,0 +1,72 @@
+package mcminterface
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy controls how a query retries nodes replying OP_BUSY or OP_NACK
+type RetryPolicy struct {
+	MaxAttempts int           // attempts per query slot, including the first one
+	BaseDelay   time.Duration // delay before the first retry, doubled on every retry
+	MaxDelay    time.Duration // upper bound of the delay, 0 for none
+	Jitter      float64       // fraction of the delay that is randomized, clamped to 0..1
+	SwitchNode  bool          // retry on another node of the table instead of the same one
+}
+
+// Default retry policy of a Client
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   250 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+	Jitter:      0.5,
+	SwitchNode:  true,
+}
+
+// NodeOutcome is the final outcome of a query slot
+type NodeOutcome struct {
+	IP       string        // node that gave the final answer
+	Attempts int           // attempts made, over all the nodes tried
+	Duration time.Duration // time spent including backoff
+	Err      error         // nil on success
+}
+
+// Get the delay before retry number attempt (starting from 1)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		if (p.MaxDelay > 0 && delay >= p.MaxDelay) || delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	jitter := min(max(p.Jitter, 0), 1)
+	if jitter > 0 && delay > 0 {
+		// remove up to jitter of the delay
+		delay -= time.Duration(jitter * rand.Float64() * float64(delay))
+	}
+	return delay
+}
+
+// Check if err is worth another attempt
+func isRetryable(err error) bool {
+	return errors.Is(err, ErrNodeBusy) || errors.Is(err, ErrNACK)
+}
+
+// Wait for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
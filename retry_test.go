@@ -0,0 +1,67 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first retry", RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 1, 100 * time.Millisecond},
+		{"doubled", RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 3, 400 * time.Millisecond},
+		{"capped", RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}, 10, time.Second},
+		{"no cap", RetryPolicy{BaseDelay: 100 * time.Millisecond}, 5, 1600 * time.Millisecond},
+		{"negative jitter", RetryPolicy{BaseDelay: 100 * time.Millisecond, Jitter: -1}, 2, 200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if got := test.policy.Backoff(test.attempt); got != test.want {
+			t.Errorf("%s: Backoff(%d) = %v, want %v", test.name, test.attempt, got, test.want)
+		}
+	}
+
+	// Without a cap the delay must not overflow
+	if got := (RetryPolicy{BaseDelay: time.Second}).Backoff(100); got <= 0 {
+		t.Errorf("uncapped Backoff(100) = %v", got)
+	}
+	// A jitter above 1 removes at most the whole delay
+	policy := RetryPolicy{BaseDelay: time.Second, Jitter: 5}
+	for i := 0; i < 100; i++ {
+		if got := policy.Backoff(1); got < 0 || got > time.Second {
+			t.Fatalf("Backoff with jitter 5 = %v", got)
+		}
+	}
+}
+
+func TestRetryKeepsStartIPs(t *testing.T) {
+	address := randomAddress()
+	start, start_addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetBalance(address, 5)
+	})
+	_, table_addrs := startMockNodes(t, 1, func(node *MockNode) {
+		node.SetBalance(address, 1)
+	})
+	client := newMockClient(t, start_addrs, WithQuerySize(1),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, SwitchNode: true}))
+	client.updateNode(RemoteNode{IP: table_addrs[0]})
+
+	if spares := client.spareNodes(client.PickNodes(1, OP_BALANCE), OP_BALANCE); len(spares) != 0 {
+		t.Errorf("spare nodes %v, want none", spares)
+	}
+
+	// The retry of the busy start node must not move to the node table
+	start[0].SetBusy(1)
+	balance, err := client.QueryBalance(context.Background(), hex.EncodeToString(address[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 5 {
+		t.Errorf("balance %d from the node table, want 5 from the start node", balance)
+	}
+}
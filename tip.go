@@ -0,0 +1,168 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// NodeTip is the chain tip a node announces in OP_HELLO_ACK
+type NodeTip struct {
+	Block  uint64        // Cblock: block number of the tip
+	Hash   [HASHLEN]byte // Cblockhash: hash of the tip
+	Phash  [HASHLEN]byte // Pblockhash: hash of the block before the tip
+	Weight [HASHLEN]byte // Weight: 256-bit chain weight, little endian
+}
+
+// Read the tip from the fields of a frame
+func (t *NodeTip) get(tx *TX) {
+	t.Block = binary.LittleEndian.Uint64(tx.Cblock[:])
+	t.Hash = tx.Cblockhash
+	t.Phash = tx.Pblockhash
+	t.Weight = tx.Weight
+}
+
+// Write the tip into the fields of a frame
+func (t *NodeTip) put(tx *TX) {
+	binary.LittleEndian.PutUint64(tx.Cblock[:], t.Block)
+	tx.Cblockhash = t.Hash
+	tx.Pblockhash = t.Phash
+	tx.Weight = t.Weight
+}
+
+// Compare two little endian 256-bit chain weights, returning -1, 0 or +1
+func CompareWeight(a, b [HASHLEN]byte) int {
+	for i := HASHLEN - 1; i >= 0; i-- {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// TipStatus places the tip of a node against the network tip
+type TipStatus int
+
+const (
+	TipSynced  TipStatus = iota // same tip
+	TipAhead                    // heavier chain, not confirmed by other nodes yet
+	TipBehind                   // lighter chain
+	TipFork                     // on a different chain
+	TipUnknown                  // no network tip was agreed
+)
+
+func (s TipStatus) String() string {
+	switch s {
+	case TipSynced:
+		return "synced"
+	case TipAhead:
+		return "ahead"
+	case TipBehind:
+		return "behind"
+	case TipFork:
+		return "fork"
+	}
+	return "unknown"
+}
+
+// Place tip against the network tip. Tips at the same height, or one
+// block apart, must be linked by their hashes to be on the same chain.
+func tipStatus(tip NodeTip, network NodeTip) TipStatus {
+	switch {
+	case tip.Hash == network.Hash:
+		return TipSynced
+	case tip.Block == network.Block:
+		return TipFork
+	case tip.Block == network.Block+1 && tip.Phash != network.Hash:
+		return TipFork
+	case tip.Block+1 == network.Block && tip.Hash != network.Phash:
+		return TipFork
+	}
+	switch CompareWeight(tip.Weight, network.Weight) {
+	case 1:
+		return TipAhead
+	case -1:
+		return TipBehind
+	}
+	return TipFork
+}
+
+// NodeTipStatus is the tip of a node and its place against the network tip
+type NodeTipStatus struct {
+	IP     string
+	Tip    NodeTip
+	Status TipStatus
+}
+
+// ChainTipReport is the outcome of QueryChainTip
+type ChainTipReport struct {
+	Tip      NodeTip         // network tip
+	Nodes    []NodeTipStatus // nodes that answered
+	Outcomes []NodeOutcome   // outcome of every node asked
+	Duration time.Duration
+}
+
+// Count the nodes with status
+func (r ChainTipReport) Count(status TipStatus) int {
+	count := 0
+	for _, node := range r.Nodes {
+		if node.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+// Find the network tip from the handshakes of QuerySize nodes: the heaviest
+// tip announced by at least two nodes, so that a single node cannot set it,
+// or the tip of the only node that answered. The report places every node
+// against it. The error is a *QuorumError if no node answered or no tip is
+// announced by two nodes, the nodes of the report are then TipUnknown.
+func (c *Client) QueryChainTip(ctx context.Context) (ChainTipReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.queryTimeout())
+	defer cancel()
+
+	// The tip comes with the handshake, there is nothing else to ask
+	start := time.Now()
+	results := queryNodes(ctx, c, c.querySize(), OP_HELLO, func(ctx context.Context, sd *SocketData) (NodeTip, error) {
+		return sd.Tip(), nil
+	})
+
+	report := ChainTipReport{Outcomes: make([]NodeOutcome, len(results)), Duration: time.Since(start)}
+	counts := make(map[NodeTip]int)
+	for i, result := range results {
+		report.Outcomes[i] = result.outcome
+		if result.outcome.Err == nil {
+			report.Nodes = append(report.Nodes, NodeTipStatus{IP: result.outcome.IP, Tip: result.value})
+			counts[result.value]++
+		}
+	}
+	if len(report.Nodes) == 0 {
+		c.metrics.observeQuorumFailure("chain_tip")
+		return report, &QuorumError{Query: "chain tip", Quorum: 1, Outcomes: report.Outcomes}
+	}
+
+	needed := min(2, len(report.Nodes))
+	found := false
+	for tip, count := range counts {
+		if count >= needed && (!found || CompareWeight(tip.Weight, report.Tip.Weight) > 0) {
+			report.Tip = tip
+			found = true
+		}
+	}
+	if !found {
+		// every node announced a different tip
+		c.metrics.observeQuorumFailure("chain_tip")
+		for i := range report.Nodes {
+			report.Nodes[i].Status = TipUnknown
+		}
+		return report, &QuorumError{Query: "chain tip", Quorum: needed, Outcomes: report.Outcomes}
+	}
+	for i := range report.Nodes {
+		report.Nodes[i].Status = tipStatus(report.Nodes[i].Tip, report.Tip)
+	}
+	return report, nil
+}
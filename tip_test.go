@@ -0,0 +1,106 @@
+package mcminterface
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// The tip of chain at block bnum, with a weight growing with the height
+func testTip(chain []BTRAILER, bnum int) NodeTip {
+	var tip NodeTip
+	tip.Block = uint64(bnum)
+	tip.Hash = chain[bnum].Bhash
+	tip.Phash = chain[bnum].Phash
+	binary.LittleEndian.PutUint64(tip.Weight[:], uint64(bnum)*1000)
+	return tip
+}
+
+func TestCompareWeight(t *testing.T) {
+	var low, high [HASHLEN]byte
+	low[0] = 0xff
+	high[HASHLEN-1] = 1
+	if CompareWeight(low, high) != -1 || CompareWeight(high, low) != 1 || CompareWeight(high, high) != 0 {
+		t.Error("weights must compare as little endian numbers")
+	}
+}
+
+// Start a mock node announcing each of tips
+func startTipNodes(t *testing.T, tips ...NodeTip) []string {
+	t.Helper()
+	addrs := make([]string, len(tips))
+	for i, tip := range tips {
+		_, node := startMockNodes(t, 1, func(node *MockNode) {
+			node.SetTip(tip)
+		})
+		addrs[i] = node[0]
+	}
+	return addrs
+}
+
+func TestQueryChainTip(t *testing.T) {
+	chain := testChain(102)
+	fork := testTip(chain, 100)
+	rand.Read(fork.Hash[:])
+	tips := []NodeTip{testTip(chain, 100), testTip(chain, 100), testTip(chain, 99), testTip(chain, 101), fork}
+	expected := []TipStatus{TipSynced, TipSynced, TipBehind, TipAhead, TipFork}
+
+	addrs := startTipNodes(t, tips...)
+	status := make(map[string]TipStatus)
+	for i, addr := range addrs {
+		status[addr] = expected[i]
+	}
+	client := newMockClient(t, addrs)
+	ctx := context.Background()
+
+	sd, err := ConnectToNode(ctx, addrs[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.Tip() != tips[3] {
+		t.Errorf("handshake tip %+v, want %+v", sd.Tip(), tips[3])
+	}
+	sd.Close()
+
+	report, err := client.QueryChainTip(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Tip != tips[0] || len(report.Nodes) != len(tips) {
+		t.Errorf("network tip at block %d from %d nodes, want block 100 from %d", report.Tip.Block, len(report.Nodes), len(tips))
+	}
+	for _, node := range report.Nodes {
+		if node.Status != status[node.IP] {
+			t.Errorf("node %s is %v, want %v", node.IP, node.Status, status[node.IP])
+		}
+	}
+	if report.Count(TipSynced) != 2 || report.Count(TipFork) != 1 {
+		t.Errorf("%d synced and %d forked nodes, want 2 and 1", report.Count(TipSynced), report.Count(TipFork))
+	}
+
+	// A single node claiming a far heavier chain cannot set the tip
+	inflated := testTip(chain, 101)
+	for i := range inflated.Weight {
+		inflated.Weight[i] = 0xff
+	}
+	addrs = startTipNodes(t, testTip(chain, 100), testTip(chain, 99), inflated)
+	report, err = newMockClient(t, addrs).QueryChainTip(ctx)
+	var quorum_err *QuorumError
+	if !errors.As(err, &quorum_err) || !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("got %v, want a QuorumError", err)
+	}
+	if report.Tip != (NodeTip{}) || len(report.Nodes) != len(addrs) || report.Count(TipUnknown) != len(addrs) {
+		t.Errorf("report without quorum has tip at block %d and nodes %v", report.Tip.Block, report.Nodes)
+	}
+
+	// The only node that answers sets the tip
+	report, err = newMockClient(t, addrs[:1]).QueryChainTip(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Tip != testTip(chain, 100) || report.Count(TipSynced) != 1 {
+		t.Errorf("single node report: tip at block %d, nodes %v", report.Tip.Block, report.Nodes)
+	}
+}
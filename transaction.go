@@ -0,0 +1,86 @@
+package mcminterface
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Transaction is a signed transaction as carried by OP_TX. Send_total goes
+// to Dst_addr and Change_total to Chg_addr: the source address is spent in
+// full, its balance is Send_total + Change_total + Tx_fee.
+type Transaction struct {
+	Src_addr     [TXADDRLEN]byte
+	Dst_addr     [TXADDRLEN]byte
+	Chg_addr     [TXADDRLEN]byte
+	Send_total   uint64
+	Change_total uint64
+	Tx_fee       uint64
+	Tx_sig       [TXSIGLEN]byte
+}
+
+// Copy the transaction into the fields of a frame
+func (t *Transaction) put(tx *TX) {
+	tx.Src_addr = t.Src_addr
+	tx.Dst_addr = t.Dst_addr
+	tx.Chg_addr = t.Chg_addr
+	binary.LittleEndian.PutUint64(tx.Send_total[:], t.Send_total)
+	binary.LittleEndian.PutUint64(tx.Change_total[:], t.Change_total)
+	binary.LittleEndian.PutUint64(tx.Tx_fee[:], t.Tx_fee)
+	tx.Tx_sig = t.Tx_sig
+}
+
+// Read the transaction from the fields of a frame
+func (t *Transaction) get(tx *TX) {
+	t.Src_addr = tx.Src_addr
+	t.Dst_addr = tx.Dst_addr
+	t.Chg_addr = tx.Chg_addr
+	t.Send_total = binary.LittleEndian.Uint64(tx.Send_total[:])
+	t.Change_total = binary.LittleEndian.Uint64(tx.Change_total[:])
+	t.Tx_fee = binary.LittleEndian.Uint64(tx.Tx_fee[:])
+	t.Tx_sig = tx.Tx_sig
+}
+
+// BroadcastReport is the outcome of BroadcastTransaction
+type BroadcastReport struct {
+	Accepted    int           // nodes that acknowledged the transaction
+	Rejected    int           // nodes that refused it with OP_NACK
+	Unconfirmed int           // nodes that closed the connection without an answer
+	Outcomes    []NodeOutcome // outcome of every node, Err is nil if accepted
+	Duration    time.Duration
+}
+
+// Submit tx to n nodes from PickNodes at the same time, retrying busy
+// nodes according to the retry policy. The report lists the outcome of
+// every node, the error is a *QuorumError if no node acknowledged tx,
+// even if some of them hung up after taking it (see Unconfirmed).
+func (c *Client) BroadcastTransaction(ctx context.Context, tx Transaction, n int) (BroadcastReport, error) {
+	if n <= 0 {
+		n = c.querySize()
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.queryTimeout())
+	defer cancel()
+
+	start := time.Now()
+	results := queryNodes(ctx, c, n, OP_TX, func(ctx context.Context, sd *SocketData) (struct{}, error) {
+		return struct{}{}, sd.SubmitTransaction(ctx, tx)
+	})
+
+	report := BroadcastReport{Outcomes: make([]NodeOutcome, len(results)), Duration: time.Since(start)}
+	for i, result := range results {
+		report.Outcomes[i] = result.outcome
+		switch {
+		case result.outcome.Err == nil:
+			report.Accepted++
+		case errors.Is(result.outcome.Err, ErrTxRejected):
+			report.Rejected++
+		case errors.Is(result.outcome.Err, ErrTxUnconfirmed):
+			report.Unconfirmed++
+		}
+	}
+	if report.Accepted == 0 {
+		return report, &QuorumError{Query: "transaction", Quorum: 1, Outcomes: report.Outcomes}
+	}
+	return report, nil
+}
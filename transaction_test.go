@@ -0,0 +1,94 @@
+package mcminterface
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// A signed transaction spending 1000
+func testTransaction() Transaction {
+	var tx Transaction
+	rand.Read(tx.Src_addr[:])
+	rand.Read(tx.Dst_addr[:])
+	rand.Read(tx.Chg_addr[:])
+	rand.Read(tx.Tx_sig[:])
+	tx.Send_total, tx.Change_total, tx.Tx_fee = 600, 390, 10
+	return tx
+}
+
+func TestBroadcastTransaction(t *testing.T) {
+	tx := testTransaction()
+	nodes, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetBalance(tx.Src_addr, 1000)
+	})
+	// the last node has seen another balance and refuses the transaction
+	nodes[2].SetBalance(tx.Src_addr, 1001)
+	client := newMockClient(t, addrs)
+	ctx := context.Background()
+
+	report, err := client.BroadcastTransaction(ctx, tx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accepted != 2 || report.Rejected != 1 || len(report.Outcomes) != 3 {
+		t.Errorf("report %+v, want 2 accepted and 1 rejected", report)
+	}
+	for i, node := range nodes[:2] {
+		if txs := node.Transactions(); len(txs) != 1 || txs[0] != tx {
+			t.Errorf("node %d received %d transactions, want the one sent", i, len(txs))
+		}
+	}
+
+	// Spending more than the balance is refused everywhere
+	tx.Tx_fee = 1000
+	report, err = client.BroadcastTransaction(ctx, tx, 3)
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("got %v, want ErrNoQuorum", err)
+	}
+	if report.Accepted != 0 || report.Rejected != 3 {
+		t.Errorf("report %+v, want 3 rejected", report)
+	}
+	for _, outcome := range report.Outcomes {
+		if !errors.Is(outcome.Err, ErrTxRejected) {
+			t.Errorf("outcome of %s is %v, want ErrTxRejected", outcome.IP, outcome.Err)
+		}
+	}
+}
+
+func TestBroadcastTransactionUnconfirmed(t *testing.T) {
+	tx := testTransaction()
+	nodes, addrs := startMockNodes(t, 3, func(node *MockNode) {
+		node.SetBalance(tx.Src_addr, 1000)
+	})
+	// the last node takes the transaction and hangs up
+	nodes[2].SetTxAck(false)
+	client := newMockClient(t, addrs)
+	ctx := context.Background()
+
+	report, err := client.BroadcastTransaction(ctx, tx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Accepted != 2 || report.Unconfirmed != 1 || report.Rejected != 0 {
+		t.Errorf("report %+v, want 2 accepted and 1 unconfirmed", report)
+	}
+
+	// Hang ups alone are not an acknowledgement
+	for _, node := range nodes {
+		node.SetTxAck(false)
+	}
+	report, err = client.BroadcastTransaction(ctx, tx, 3)
+	if !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("got %v, want ErrNoQuorum", err)
+	}
+	if report.Accepted != 0 || report.Unconfirmed != 3 {
+		t.Errorf("report %+v, want 3 unconfirmed", report)
+	}
+	for _, outcome := range report.Outcomes {
+		if !errors.Is(outcome.Err, ErrTxUnconfirmed) {
+			t.Errorf("outcome of %s is %v, want ErrTxUnconfirmed", outcome.IP, outcome.Err)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package mcminterface
 
 import (
 	"encoding/binary"